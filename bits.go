@@ -0,0 +1,84 @@
+package mongo
+
+import (
+	"fmt"
+
+	"github.com/oktacode/rest-layer/schema"
+)
+
+// BitTest is a predicate expression testing the bits of an integer field, like
+// a bitmask of permission flags. As the query parser doesn't accept bitwise
+// operators, it is to be appended to a parsed predicate:
+//
+//	q.Predicate = append(q.Predicate, &mongo.BitTest{Field: "perms", Op: "$bitsAllSet", Positions: []int{0, 3}})
+type BitTest struct {
+	Field string
+	// Op is one of $bitsAllSet, $bitsAnySet, $bitsAllClear or $bitsAnyClear.
+	Op string
+	// Positions lists the positions of the bits to test, the least
+	// significant bit being at position 0.
+	Positions []int
+}
+
+// bitOps lists the supported bitwise operators.
+var bitOps = map[string]bool{"$bitsAllSet": true, "$bitsAnySet": true, "$bitsAllClear": true, "$bitsAnyClear": true}
+
+// validate checks the operator and bit positions of e.
+func (e *BitTest) validate() error {
+	if !bitOps[e.Op] {
+		return fmt.Errorf("%s: unknown bitwise operator: %s", e.Field, e.Op)
+	}
+	if len(e.Positions) == 0 {
+		return fmt.Errorf("%s: %s: empty bit position list", e.Field, e.Op)
+	}
+	for _, p := range e.Positions {
+		if p < 0 || p > 63 {
+			return fmt.Errorf("%s: %s: invalid bit position: %d", e.Field, e.Op, p)
+		}
+	}
+	return nil
+}
+
+// Match implements query.Expression.
+func (e *BitTest) Match(payload map[string]interface{}) bool {
+	var n int64
+	switch v := payload[e.Field].(type) {
+	case int:
+		n = int64(v)
+	case int32:
+		n = int64(v)
+	case int64:
+		n = v
+	case float64:
+		n = int64(v)
+	default:
+		return false
+	}
+	set := 0
+	for _, p := range e.Positions {
+		if n&(1<<uint(p)) != 0 {
+			set++
+		}
+	}
+	switch e.Op {
+	case "$bitsAllSet":
+		return set == len(e.Positions)
+	case "$bitsAnySet":
+		return set > 0
+	case "$bitsAllClear":
+		return set == 0
+	case "$bitsAnyClear":
+		return set < len(e.Positions)
+	}
+	return false
+}
+
+// Prepare implements query.Expression.
+func (e *BitTest) Prepare(validator schema.Validator) error {
+	return e.validate()
+}
+
+// String implements query.Expression.
+func (e *BitTest) String() string {
+	return fmt.Sprintf("{%s: {%s: %v}}", e.Field, e.Op, e.Positions)
+}
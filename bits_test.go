@@ -0,0 +1,48 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTranslateBitTest(t *testing.T) {
+	for _, op := range []string{"$bitsAllSet", "$bitsAnySet", "$bitsAllClear", "$bitsAnyClear"} {
+		got, err := translator{}.translatePredicate(query.Predicate{&BitTest{Field: "perms", Op: op, Positions: []int{0, 3}}})
+		assert.NoError(t, err, op)
+		assert.Equal(t, bson.M{"perms": bson.M{op: []int{0, 3}}}, got, op)
+	}
+
+	_, err := translator{}.translatePredicate(query.Predicate{&BitTest{Field: "perms", Op: "$bitsSet", Positions: []int{0}}})
+	assert.EqualError(t, err, "perms: unknown bitwise operator: $bitsSet")
+	_, err = translator{}.translatePredicate(query.Predicate{&BitTest{Field: "perms", Op: "$bitsAllSet"}})
+	assert.EqualError(t, err, "perms: $bitsAllSet: empty bit position list")
+	_, err = translator{}.translatePredicate(query.Predicate{&BitTest{Field: "perms", Op: "$bitsAllSet", Positions: []int{1, -1}}})
+	assert.EqualError(t, err, "perms: $bitsAllSet: invalid bit position: -1")
+	assert.Error(t, (&BitTest{Field: "perms", Op: "$bitsAnySet", Positions: []int{64}}).Prepare(nil))
+}
+
+func TestBitTestMatch(t *testing.T) {
+	payload := map[string]interface{}{"perms": 0x9} // bits 0 and 3
+	cases := []struct {
+		op        string
+		positions []int
+		want      bool
+	}{
+		{"$bitsAllSet", []int{0, 3}, true},
+		{"$bitsAllSet", []int{0, 1}, false},
+		{"$bitsAnySet", []int{1, 3}, true},
+		{"$bitsAnySet", []int{1, 2}, false},
+		{"$bitsAllClear", []int{1, 2}, true},
+		{"$bitsAllClear", []int{0, 1}, false},
+		{"$bitsAnyClear", []int{0, 1}, true},
+		{"$bitsAnyClear", []int{0, 3}, false},
+	}
+	for _, tc := range cases {
+		e := &BitTest{Field: "perms", Op: tc.op, Positions: tc.positions}
+		assert.Equal(t, tc.want, e.Match(payload), "%s %v", tc.op, tc.positions)
+	}
+	assert.False(t, (&BitTest{Field: "perms", Op: "$bitsAllClear", Positions: []int{0}}).Match(map[string]interface{}{"perms": "foo"}))
+}
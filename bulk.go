@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/oktacode/rest-layer/resource"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// upsertBatchSize is the maximum number of items upserted by a single update
+// command, the write batch size limit of MongoDB before 3.6.
+const upsertBatchSize = 1000
+
+// upsertOp is a statement of an update command replacing an item by its id,
+// or inserting it if not stored yet.
+type upsertOp struct {
+	Q      bson.M     `bson:"q"`
+	U      *mongoItem `bson:"u"`
+	Upsert bool       `bson:"upsert"`
+}
+
+// updateReply is the reply of an update command.
+type updateReply struct {
+	N        int `bson:"n"`
+	Upserted []struct {
+		Index int `bson:"index"`
+	} `bson:"upserted"`
+	WriteErrors []struct {
+		Index  int    `bson:"index"`
+		Code   int    `bson:"code"`
+		ErrMsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+}
+
+// UpsertMany stores each of items by its id, replacing the stored item if any
+// or inserting it otherwise, whatever its stored etag. The items are written
+// with bulk update commands of up to 1000 upserts each. It returns the number
+// of items inserted and replaced. The operation stops at the first failing
+// item, the items before it being stored.
+func (m Handler) UpsertMany(ctx context.Context, items []*resource.Item) (inserted, updated int, err error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	ops, err := m.upsertOps(items)
+	if err != nil {
+		return 0, 0, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer m.close(c)
+	for len(ops) > 0 {
+		n := len(ops)
+		if n > upsertBatchSize {
+			n = upsertBatchSize
+		}
+		var reply updateReply
+		cmd := bson.D{
+			{Name: "update", Value: c.Name},
+			{Name: "updates", Value: ops[:n]},
+			{Name: "ordered", Value: true},
+		}
+		if wc := writeConcern(ctx); wc != nil {
+			// Commands ignore the safe mode of the session
+			cmd = append(cmd, bson.DocElem{Name: "writeConcern", Value: wc})
+		}
+		err = c.Database.Run(cmd, &reply)
+		if err != nil {
+			break
+		}
+		inserted += len(reply.Upserted)
+		updated += reply.N - len(reply.Upserted)
+		if len(reply.WriteErrors) > 0 {
+			e := reply.WriteErrors[0]
+			err = &mgo.QueryError{Code: e.Code, Message: e.ErrMsg}
+			break
+		}
+		ops = ops[n:]
+	}
+	if ctx.Err() != nil {
+		return inserted, updated, ctx.Err()
+	}
+	if mgo.IsDup(err) {
+		return inserted, updated, resource.ErrConflict
+	}
+	return inserted, updated, m.mapError(err)
+}
+
+// upsertOps returns the statements of the update commands of UpsertMany,
+// whose filters include the shard key set with WithShardKey, as required for
+// upserts in a sharded collection.
+func (m Handler) upsertOps(items []*resource.Item) ([]upsertOp, error) {
+	ops := make([]upsertOp, len(items))
+	for i, item := range items {
+		mItem, err := m.toMongoItem(item)
+		if err != nil {
+			return nil, err
+		}
+		q := bson.M{"_id": mItem.ID}
+		if err := m.addShardKey(q, item.Payload); err != nil {
+			return nil, err
+		}
+		ops[i] = upsertOp{Q: q, U: mItem, Upsert: true}
+	}
+	return ops, nil
+}
@@ -0,0 +1,62 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestUpsertOpsShardKey(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithShardKey([]string{"tenant", "region"}))
+	ops, err := h.upsertOps([]*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "tenant": "t1", "region": "eu"}},
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "tenant": "t2"}},
+	})
+	require.NoError(t, err)
+	if assert.Len(t, ops, 2) {
+		assert.Equal(t, bson.M{"_id": "1", "tenant": "t1", "region": "eu"}, ops[0].Q)
+		assert.Equal(t, bson.M{"_id": "2", "tenant": "t2"}, ops[1].Q)
+		assert.True(t, ops[0].Upsert)
+	}
+}
+
+func TestUpsertMany(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testupsertmany")()
+	h := NewHandler(s, "testupsertmany", "test")
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+		{ID: "2", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "2", "foo": "bar"}},
+	}))
+
+	items := []*resource.Item{}
+	for i := 1; i <= 1500; i++ {
+		id := fmt.Sprint(i)
+		items = append(items, &resource.Item{ID: id, ETag: "b", Updated: now, Payload: map[string]interface{}{"id": id, "foo": "baz"}})
+	}
+	inserted, updated, err := h.UpsertMany(ctx, items)
+	assert.NoError(t, err)
+	assert.Equal(t, 1498, inserted)
+	assert.Equal(t, 2, updated)
+
+	d := map[string]interface{}{}
+	require.NoError(t, s.DB("testupsertmany").C("test").FindId("1").One(&d))
+	assert.Equal(t, "b", d["_etag"])
+	assert.Equal(t, "baz", d["foo"])
+	n, err := s.DB("testupsertmany").C("test").Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1500, n)
+}
@@ -0,0 +1,25 @@
+package mongo
+
+import "fmt"
+
+// encodeID returns the stored representation of the item id, using the codec
+// set with WithIDCodec if any.
+func (t translator) encodeID(id interface{}) (interface{}, error) {
+	if t.idEncode == nil {
+		return id, nil
+	}
+	s, ok := id.(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid id type %T: the id codec requires strings", id)
+	}
+	return t.idEncode(s)
+}
+
+// decodeID returns the item id of the stored id, using the codec set with
+// WithIDCodec if any.
+func (t translator) decodeID(id interface{}) (interface{}, error) {
+	if t.idDecode == nil {
+		return id, nil
+	}
+	return t.idDecode(id)
+}
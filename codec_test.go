@@ -0,0 +1,134 @@
+package mongo
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// uuidCodec stores UUID strings as BSON binaries of subtype 4.
+var uuidCodec = WithIDCodec(
+	func(id string) (interface{}, error) {
+		b, err := hex.DecodeString(strings.Replace(id, "-", "", -1))
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("invalid uuid: %q", id)
+		}
+		return bson.Binary{Kind: 0x04, Data: b}, nil
+	},
+	func(v interface{}) (string, error) {
+		b, ok := v.(bson.Binary)
+		if !ok || b.Kind != 0x04 || len(b.Data) != 16 {
+			return "", fmt.Errorf("invalid stored uuid: %v", v)
+		}
+		h := hex.EncodeToString(b.Data)
+		return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+	},
+)
+
+const (
+	uuid1 = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	uuid2 = "6ba7b811-9dad-11d1-80b4-00c04fd430c8"
+)
+
+func uuidBinary(id string) bson.Binary {
+	b, _ := hex.DecodeString(strings.Replace(id, "-", "", -1))
+	return bson.Binary{Kind: 0x04, Data: b}
+}
+
+func TestIDCodecRoundTrip(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", uuidCodec)
+	item := &resource.Item{ID: uuid1, ETag: "a", Payload: map[string]interface{}{"id": uuid1, "foo": "bar"}}
+	mItem, err := h.toMongoItem(item)
+	require.NoError(t, err)
+	assert.Equal(t, uuidBinary(uuid1), mItem.ID)
+
+	// Read back as decoded by mgo
+	b, err := bson.Marshal(mItem)
+	require.NoError(t, err)
+	var back mongoItem
+	require.NoError(t, bson.Unmarshal(b, &back))
+	got, err := h.toItem(&back)
+	require.NoError(t, err)
+	assert.Equal(t, item, got)
+
+	_, err = h.toMongoItem(&resource.Item{ID: "foo"})
+	assert.EqualError(t, err, `invalid uuid: "foo"`)
+	_, err = h.toMongoItem(&resource.Item{ID: 1})
+	assert.EqualError(t, err, "invalid id type int: the id codec requires strings")
+	_, err = h.toItem(&mongoItem{ID: "foo"})
+	assert.EqualError(t, err, "invalid stored uuid: foo")
+}
+
+func TestIDCodecPredicate(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", uuidCodec)
+	got, err := h.translatePredicate(query.MustParsePredicate(`{id:"` + uuid1 + `"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": uuidBinary(uuid1)}, got)
+
+	got, err = h.translatePredicate(query.MustParsePredicate(`{id:{$in:["` + uuid1 + `","` + uuid2 + `"]}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": bson.M{"$in": []interface{}{uuidBinary(uuid1), uuidBinary(uuid2)}}}, got)
+
+	_, err = h.translatePredicate(query.MustParsePredicate(`{id:{$nin:["foo"]}}`))
+	assert.EqualError(t, err, `invalid uuid: "foo"`)
+
+	// Range comparands are encoded as well
+	got, err = h.translatePredicate(query.MustParsePredicate(`{id:{$gt:"` + uuid1 + `"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": bson.M{"$gt": uuidBinary(uuid1)}}, got)
+
+	s, err := h.itemSelector(&resource.Item{ID: uuid1, ETag: "a"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": uuidBinary(uuid1), "_etag": "a"}, s)
+}
+
+func TestIDCodecStorage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testidcodec")()
+	h := NewHandler(s, "testidcodec", "test", uuidCodec)
+	ctx := context.Background()
+	items := []*resource.Item{
+		{ID: uuid1, ETag: "a", Payload: map[string]interface{}{"id": uuid1, "n": 1}},
+		{ID: uuid2, ETag: "b", Payload: map[string]interface{}{"id": uuid2, "n": 2}},
+	}
+	require.NoError(t, h.Insert(ctx, items))
+
+	var d bson.M
+	require.NoError(t, s.DB("testidcodec").C("test").Find(bson.M{"n": 1}).One(&d))
+	assert.Equal(t, uuidBinary(uuid1), d["_id"])
+
+	l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:{$in:["` + uuid1 + `"]}}`)})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, uuid1, l.Items[0].ID)
+	assert.Equal(t, uuid1, l.Items[0].Payload["id"])
+
+	updated := &resource.Item{ID: uuid1, ETag: "c", Payload: map[string]interface{}{"id": uuid1, "n": 3}}
+	require.NoError(t, h.Update(ctx, updated, l.Items[0]))
+	assert.Equal(t, resource.ErrConflict, h.Update(ctx, updated, l.Items[0]))
+
+	require.NoError(t, h.Delete(ctx, updated))
+	assert.Equal(t, resource.ErrNotFound, h.Delete(ctx, updated))
+
+	got, err := h.MultiGet(ctx, []interface{}{uuid2, uuid1})
+	require.NoError(t, err)
+	if assert.Len(t, got, 2) && assert.NotNil(t, got[0]) {
+		assert.Equal(t, uuid2, got[0].ID)
+		assert.Nil(t, got[1])
+	}
+}
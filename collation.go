@@ -0,0 +1,82 @@
+package mongo
+
+import (
+	"time"
+
+	"github.com/oktacode/rest-layer/schema/query"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Collation defines the language specific rules used to compare strings. See
+// https://docs.mongodb.com/manual/reference/collation/ for details.
+type Collation struct {
+	// Locale is the ICU locale, like "en" or "fr_CA".
+	Locale string `bson:"locale"`
+	// CaseLevel enables case comparison at strength 1 or 2.
+	CaseLevel bool `bson:"caseLevel,omitempty"`
+	// CaseFirst may be "upper", "lower" or "off".
+	CaseFirst string `bson:"caseFirst,omitempty"`
+	// Strength is the level of comparison to perform, from 1 to 5. With a
+	// strength of 1 or 2, comparisons are case insensitive.
+	Strength int `bson:"strength,omitempty"`
+	// NumericOrdering compares numeric strings as numbers.
+	NumericOrdering bool `bson:"numericOrdering,omitempty"`
+	// Alternate may be "non-ignorable" or "shifted".
+	Alternate string `bson:"alternate,omitempty"`
+	// MaxVariable may be "punct" or "space".
+	MaxVariable string `bson:"maxVariable,omitempty"`
+	// Backwards sorts strings with diacritics from back of the string.
+	Backwards bool `bson:"backwards,omitempty"`
+}
+
+// findCommand builds a find command applying the collation of the handler.
+func (m Handler) findCommand(c *mgo.Collection, qry bson.M, srt []string, q *query.Query, maxTime time.Duration) bson.D {
+	cmd := bson.D{
+		{Name: "find", Value: c.Name},
+		{Name: "filter", Value: qry},
+		{Name: "sort", Value: getSortStage(srt)},
+		{Name: "collation", Value: m.collation},
+	}
+	if proj := m.getProjection(q); proj != nil {
+		cmd = append(cmd, bson.DocElem{Name: "projection", Value: proj})
+	}
+	if w := q.Window; w != nil {
+		if w.Offset > 0 {
+			cmd = append(cmd, bson.DocElem{Name: "skip", Value: w.Offset})
+		}
+		if w.Limit > -1 {
+			cmd = append(cmd, bson.DocElem{Name: "limit", Value: w.Limit})
+		}
+	}
+	if maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: int64(maxTime / time.Millisecond)})
+	}
+	return cmd
+}
+
+// findCollation runs a find command using the collation of the handler as
+// mgo.Query does not support collations.
+func (m Handler) findCollation(c *mgo.Collection, qry bson.M, srt []string, q *query.Query, maxTime time.Duration) *mgo.Iter {
+	var r cursorReply
+	err := c.Database.Run(m.findCommand(c, qry, srt, q, maxTime), &r)
+	return c.NewIter(nil, r.Cursor.FirstBatch, r.Cursor.ID, err)
+}
+
+// countCollation counts the documents matching qry using the collation of the
+// handler.
+func (m Handler) countCollation(c *mgo.Collection, qry bson.M, maxTime time.Duration) (int, error) {
+	cmd := bson.D{
+		{Name: "count", Value: c.Name},
+		{Name: "query", Value: qry},
+		{Name: "collation", Value: m.collation},
+	}
+	if maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: int64(maxTime / time.Millisecond)})
+	}
+	var r struct {
+		N int `bson:"n"`
+	}
+	err := c.Database.Run(cmd, &r)
+	return r.N, err
+}
@@ -0,0 +1,64 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFindCommand(t *testing.T) {
+	coll := Collation{Locale: "en", Strength: 2}
+	h := NewHandler(&mgo.Session{}, "db", "test", WithCollation(coll))
+	c := (&mgo.Session{}).DB("db").C("test")
+	cmd := h.findCommand(c, bson.M{"name": "BOB"}, []string{"-name"}, &query.Query{Window: &query.Window{Offset: 10, Limit: 5}}, 2*time.Second)
+	assert.Equal(t, bson.D{
+		{Name: "find", Value: "test"},
+		{Name: "filter", Value: bson.M{"name": "BOB"}},
+		{Name: "sort", Value: bson.D{{Name: "name", Value: -1}}},
+		{Name: "collation", Value: &coll},
+		{Name: "skip", Value: 10},
+		{Name: "limit", Value: 5},
+		{Name: "maxTimeMS", Value: int64(2000)},
+	}, cmd)
+}
+
+func TestFindCollation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindcollation")()
+	h := NewHandler(s, "testfindcollation", "test", WithCollation(Collation{Locale: "en", Strength: 2}))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "bob"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "alice"}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{name:"BOB"}`, "", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "1", l.Items[0].ID)
+	}
+	n, err := h.Count(ctx, q)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// Without the collation, equality is case sensitive
+	l, err = NewHandler(s, "testfindcollation", "test").Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 0)
+	}
+}
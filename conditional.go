@@ -0,0 +1,124 @@
+package mongo
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/oktacode/rest-layer/schema/query"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ConditionalUpdate sets the fields of patch on the item with the given id
+// only if its stored fields are equal to the values of cond, for instance to
+// move an item to a status only from a given one, and tells if the update was
+// applied. The condition and the update are applied atomically by a single
+// findAndModify command. False is returned, without error, when the item
+// doesn't exist or doesn't match cond.
+//
+// The condition values are converted like equality predicate comparands and
+// the patch values like stored payload fields. The item gets a new etag and
+// update date, and its version is incremented when WithVersionField is set.
+// The id and the fields storing the item metadata can't be patched. On a
+// sharded collection, cond or patch must hold the WithShardKey fields for the
+// command to be routed to the shard of the item.
+func (m Handler) ConditionalUpdate(ctx context.Context, id interface{}, cond, patch map[string]interface{}) (bool, error) {
+	if len(patch) == 0 {
+		return false, fmt.Errorf("empty patch")
+	}
+	set := make(map[string]interface{}, len(patch)+2)
+	for f, v := range patch {
+		if getField(f) == "_id" || internalFields[f] || (f == m.versionField && f != "") {
+			return false, fmt.Errorf("invalid field %q: can't be patched", f)
+		}
+		set[f] = v
+	}
+	if err := m.encodeEnumPayload(set); err != nil {
+		return false, err
+	}
+	if err := m.encodeTimestampPayload(set); err != nil {
+		return false, err
+	}
+	if err := m.encryptPayload(set); err != nil {
+		return false, err
+	}
+	s, err := m.conditionSelector(id, cond, patch)
+	if err != nil {
+		return false, err
+	}
+	etag, err := newETag()
+	if err != nil {
+		return false, err
+	}
+	set["_etag"] = etag
+	u := bson.M{"$set": set}
+	if m.currentDate {
+		u["$currentDate"] = bson.M{"_updated": true}
+	} else {
+		updated := time.Now()
+		if m.timePrecision > 0 {
+			updated = updated.Truncate(m.timePrecision)
+		}
+		set["_updated"] = updated
+	}
+	if m.versionField != "" {
+		u["$inc"] = bson.M{m.versionField: 1}
+	}
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer m.close(c)
+	var res bson.M
+	_, err = apply(ctx, c, s, bson.M{"_id": 1}, mgo.Change{Update: u}, &res)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, m.mapError(err)
+	}
+	m.mutated("update", id)
+	return true, nil
+}
+
+// conditionSelector returns the selector matching the item with the given id
+// whose fields are equal to the values of cond. The shard key fields not in
+// cond are taken from patch when it sets them.
+func (m Handler) conditionSelector(id interface{}, cond, patch map[string]interface{}) (bson.M, error) {
+	fields := make([]string, 0, len(cond))
+	for f := range cond {
+		fields = append(fields, f)
+	}
+	// Sort the fields for the selector to be deterministic
+	sort.Strings(fields)
+	p := query.Predicate{&query.Equal{Field: "id", Value: id}}
+	for _, f := range fields {
+		p = append(p, &query.Equal{Field: f, Value: cond[f]})
+	}
+	s, err := m.getQuery(&query.Query{Predicate: p})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.addShardKey(s, cond, patch); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newETag returns a random etag for the items modified without being
+// provided one.
+func newETag() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
@@ -0,0 +1,87 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestConditionSelector(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithEnumMapping("status", map[string]int{"todo": 0, "done": 1}))
+	s, err := h.conditionSelector("1", map[string]interface{}{"status": "todo", "owner": "bob"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "status": 0, "owner": "bob"}, s)
+
+	_, err = h.conditionSelector("1", map[string]interface{}{"_etag": "a"}, nil)
+	assert.IsType(t, &InternalFieldError{}, err)
+}
+
+func TestConditionSelectorShardKey(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithShardKey([]string{"tenant", "region"}))
+	s, err := h.conditionSelector("1", map[string]interface{}{"status": "todo", "tenant": "a"}, map[string]interface{}{"region": "eu", "status": "done"})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "status": "todo", "tenant": "a", "region": "eu"}, s)
+}
+
+func TestConditionalUpdateInvalid(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithVersionField("version"))
+	ctx := context.Background()
+	_, err := h.ConditionalUpdate(ctx, "1", nil, nil)
+	assert.EqualError(t, err, "empty patch")
+	for _, f := range []string{"id", "_id", "_etag", "_updated", "version"} {
+		_, err = h.ConditionalUpdate(ctx, "1", nil, map[string]interface{}{f: "x"})
+		assert.EqualError(t, err, `invalid field "`+f+`": can't be patched`)
+	}
+}
+
+func TestConditionalUpdate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testconditionalupdate")()
+	h := NewHandler(s, "testconditionalupdate", "test")
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "status": "pending", "name": "foo"}},
+	}))
+	get := func() *resource.Item {
+		l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+		require.NoError(t, err)
+		require.Len(t, l.Items, 1)
+		return l.Items[0]
+	}
+
+	// The condition doesn't hold: nothing changes
+	ok, err := h.ConditionalUpdate(ctx, "1", map[string]interface{}{"status": "running"}, map[string]interface{}{"status": "done"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	item := get()
+	assert.Equal(t, "pending", item.Payload["status"])
+	assert.Equal(t, "a", item.ETag)
+
+	ok, err = h.ConditionalUpdate(ctx, "1", map[string]interface{}{"status": "pending"}, map[string]interface{}{"status": "running"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	item = get()
+	assert.Equal(t, map[string]interface{}{"id": "1", "status": "running", "name": "foo"}, item.Payload)
+	assert.NotEqual(t, "a", item.ETag)
+
+	// Applied once only
+	ok, err = h.ConditionalUpdate(ctx, "1", map[string]interface{}{"status": "pending"}, map[string]interface{}{"status": "running"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = h.ConditionalUpdate(ctx, "2", nil, map[string]interface{}{"status": "running"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,184 @@
+package mongo
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// NewHandlerContext dials the MongoDB server(s) described by the uri connection
+// string and creates a new mongo handler for the given db and collection on
+// top of the resulting session. The dial is aborted as soon as ctx is done.
+// The session is owned by the handler and released by Handler.Close.
+//
+// On top of the options supported by mgo (authSource, authMechanism,
+// replicaSet, maxPoolSize…), the connection string may set connectTimeoutMS,
+// to bound the dial and the operations of the session, and ssl or tls, to
+// connect to the servers with TLS. Without connectTimeoutMS, the dial times out
+// after 10 seconds, or earlier if ctx has a closer deadline, and the operations
+// after one minute, like with mgo.Dial.
+func NewHandlerContext(ctx context.Context, uri, db, collection string, opts ...Option) (Handler, error) {
+	return newHandlerDial(ctx, uri, db, collection, nil, opts...)
+}
+
+// NewHandlerDialer works like NewHandlerContext but establishes the connections
+// to the servers with dial, for instance to go thru a SOCKS proxy or to set up
+// mutual TLS. The dial function takes precedence over the ssl and tls options
+// of the connection string.
+func NewHandlerDialer(ctx context.Context, uri, db, collection string, dial func(addr *mgo.ServerAddr) (net.Conn, error), opts ...Option) (Handler, error) {
+	return newHandlerDial(ctx, uri, db, collection, dial, opts...)
+}
+
+// newHandlerDial dials the servers described by uri, using dial if not nil,
+// and creates a handler owning the resulting session.
+func newHandlerDial(ctx context.Context, uri, db, collection string, dial func(addr *mgo.ServerAddr) (net.Conn, error), opts ...Option) (Handler, error) {
+	if err := validateNames(db, collection); err != nil {
+		return Handler{}, err
+	}
+	info, err := parseURI(uri)
+	if err != nil {
+		return Handler{}, err
+	}
+	if dial != nil {
+		info.DialServer = dial
+	}
+	// Apply the options affecting the dial
+	var cfg Handler
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.err != nil {
+		return Handler{}, cfg.err
+	}
+	if cfg.poolLimit > 0 {
+		info.PoolLimit = cfg.poolLimit
+	}
+	cfg.log("debug", "dialing", "addrs", info.Addrs)
+	s, err := dialContext(ctx, info)
+	if err != nil {
+		cfg.log("error", "dial failed", "addrs", info.Addrs, "error", err)
+		return Handler{}, err
+	}
+	cfg.log("debug", "dialed", "addrs", info.Addrs)
+	h := NewHandler(s, db, collection, opts...)
+	h.state.owned = s
+	return h, nil
+}
+
+// Default timeouts of the dial and of the operations of the dialed sessions
+// when the connection string doesn't set connectTimeoutMS, as used by mgo.Dial.
+const (
+	defaultDialTimeout    = 10 * time.Second
+	defaultSessionTimeout = time.Minute
+)
+
+// dialContext establishes a new session using info, giving up when ctx is done.
+func dialContext(ctx context.Context, info *mgo.DialInfo) (*mgo.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var sessionTimeout time.Duration
+	info.Timeout, sessionTimeout = dialTimeouts(ctx, info.Timeout)
+	type result struct {
+		s   *mgo.Session
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := mgo.DialWithInfo(info)
+		done <- result{s, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		// mgo keeps the dial timeout for the operations of the session
+		r.s.SetSyncTimeout(sessionTimeout)
+		r.s.SetSocketTimeout(sessionTimeout)
+		return r.s, nil
+	case <-ctx.Done():
+		// Release the session if the dial eventually succeeds
+		go func() {
+			if r := <-done; r.s != nil {
+				r.s.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// dialTimeouts returns the timeout of a dial within ctx and the timeout of the
+// operations of the dialed session, given the timeout set by the connection
+// string, if any.
+func dialTimeouts(ctx context.Context, timeout time.Duration) (dial, session time.Duration) {
+	dial, session = timeout, timeout
+	if timeout == 0 {
+		dial, session = defaultDialTimeout, defaultSessionTimeout
+	}
+	// Don't let mgo wait longer than the context deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := deadline.Sub(time.Now()); d < dial {
+			dial = d
+		}
+	}
+	return dial, session
+}
+
+// parseURI parses the MongoDB connection string uri like mgo.ParseURL, also
+// handling the connectTimeoutMS, ssl and tls options mgo rejects.
+func parseURI(uri string) (*mgo.DialInfo, error) {
+	base, opts := uri, ""
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		base, opts = uri[:i], uri[i+1:]
+	}
+	var timeout time.Duration
+	useTLS := false
+	kept := []string{}
+	for _, pair := range strings.FieldsFunc(opts, func(r rune) bool { return r == '&' || r == ';' }) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			// Let mgo report the malformed option
+			kept = append(kept, pair)
+			continue
+		}
+		// Option names are case insensitive
+		switch strings.ToLower(kv[0]) {
+		case "connecttimeoutms":
+			ms, err := strconv.Atoi(kv[1])
+			if err != nil || ms < 0 {
+				return nil, fmt.Errorf("bad value for connectTimeoutMS: %s", kv[1])
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		case "ssl", "tls":
+			b, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad value for %s: %s", kv[0], kv[1])
+			}
+			useTLS = b
+		default:
+			kept = append(kept, pair)
+		}
+	}
+	if len(kept) > 0 {
+		base += "?" + strings.Join(kept, "&")
+	}
+	info, err := mgo.ParseURL(base)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = timeout
+	if useTLS {
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			// The server name is taken from the address
+			return tls.DialWithDialer(&net.Dialer{Timeout: info.Timeout}, "tcp", addr.String(), &tls.Config{})
+		}
+	}
+	return info, nil
+}
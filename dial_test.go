@@ -0,0 +1,197 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNewHandlerContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// 10.255.255.1 is a non-routable address, so the dial can only time out
+	_, err := NewHandlerContext(ctx, "mongodb://10.255.255.1:27017", "db", "test")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second, "dial did not honor the context deadline")
+}
+
+func TestDialTimeouts(t *testing.T) {
+	dial, session := dialTimeouts(context.Background(), 0)
+	assert.Equal(t, defaultDialTimeout, dial)
+	assert.Equal(t, defaultSessionTimeout, session)
+
+	dial, session = dialTimeouts(context.Background(), 2*time.Second)
+	assert.Equal(t, 2*time.Second, dial)
+	assert.Equal(t, 2*time.Second, session)
+
+	// The context deadline only bounds the dial
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	dial, session = dialTimeouts(ctx, 0)
+	assert.True(t, dial > 0 && dial <= 100*time.Millisecond)
+	assert.Equal(t, defaultSessionTimeout, session)
+	dial, session = dialTimeouts(ctx, 2*time.Second)
+	assert.True(t, dial > 0 && dial <= 100*time.Millisecond)
+	assert.Equal(t, 2*time.Second, session)
+}
+
+func TestNewHandlerContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewHandlerContext(ctx, "mongodb://10.255.255.1:27017", "db", "test")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestNewHandlerContextLogger(t *testing.T) {
+	var logs []string
+	logger := func(level, msg string, kv ...interface{}) {
+		logs = append(logs, level+" "+msg)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewHandlerContext(ctx, "mongodb://10.255.255.1:27017", "db", "test", WithLogger(logger))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []string{"debug dialing", "error dial failed"}, logs)
+}
+
+func TestNewHandlerContextInvalidURI(t *testing.T) {
+	_, err := NewHandlerContext(context.Background(), "mongodb://localhost:27017/?foo=bar", "db", "test")
+	assert.Error(t, err)
+}
+
+func TestParseURI(t *testing.T) {
+	info, err := parseURI("mongodb://user:pass@a:27017,b:27018/admin?authSource=users&replicaSet=rs0&connectTimeoutMS=2500&maxPoolSize=20&ssl=true")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a:27017", "b:27018"}, info.Addrs)
+	assert.Equal(t, "admin", info.Database)
+	assert.Equal(t, "user", info.Username)
+	assert.Equal(t, "pass", info.Password)
+	assert.Equal(t, "users", info.Source)
+	assert.Equal(t, "rs0", info.ReplicaSetName)
+	assert.Equal(t, 2500*time.Millisecond, info.Timeout)
+	assert.Equal(t, 20, info.PoolLimit)
+	assert.NotNil(t, info.DialServer)
+
+	info, err = parseURI("mongodb://localhost/?tls=false;connecttimeoutms=100")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost"}, info.Addrs)
+	assert.Equal(t, 100*time.Millisecond, info.Timeout)
+	assert.Nil(t, info.DialServer)
+
+	info, err = parseURI("mongodb://localhost")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), info.Timeout)
+	assert.Nil(t, info.DialServer)
+
+	_, err = parseURI("mongodb://localhost/?connectTimeoutMS=soon")
+	assert.EqualError(t, err, "bad value for connectTimeoutMS: soon")
+	_, err = parseURI("mongodb://localhost/?ssl=maybe")
+	assert.EqualError(t, err, "bad value for ssl: maybe")
+	_, err = parseURI("mongodb://localhost/?ssl=true&foo=bar")
+	assert.EqualError(t, err, "unsupported connection URL option: foo=bar")
+}
+
+func TestNewHandlerDialer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var mu sync.Mutex
+	dialed := []string{}
+	dial := func(addr *mgo.ServerAddr) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, addr.String())
+		return nil, errors.New("refused by the test dialer")
+	}
+	_, err := NewHandlerDialer(ctx, "mongodb://127.0.0.1:27999", "db", "test", dial)
+	assert.Error(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.NotEmpty(t, dialed) {
+		assert.Equal(t, "127.0.0.1:27999", dialed[0])
+	}
+}
+
+func TestHandlerCloseOwned(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	before := runtime.NumGoroutine()
+	h, err := NewHandlerContext(context.Background(), "mongodb://localhost", "testhandlercloseowned", "test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = h.Count(context.Background(), &query.Query{})
+	assert.NoError(t, err)
+
+	h.Close()
+	_, err = h.Count(context.Background(), &query.Query{})
+	assert.Equal(t, ErrClosed, err)
+	// Closing twice is harmless
+	h.Close()
+
+	// The goroutines started by the session must eventually exit
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "goroutine leak")
+}
+
+func TestNewHandlerContextPoolLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	// slowOps runs 3 concurrent operations lasting 300ms each and returns the
+	// time they took.
+	slowOps := func(h Handler) time.Duration {
+		ctx := context.Background()
+		// Seed through the handler so the setup socket goes back to the pool
+		// before the concurrent operations start.
+		require.NoError(t, h.Insert(ctx, []*resource.Item{{ID: 1, ETag: "a", Payload: map[string]interface{}{"id": 1}}}))
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := h.c(ctx)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer h.close(c)
+				var res bson.M
+				assert.NoError(t, c.Find(bson.M{"$where": "sleep(300) || true"}).One(&res))
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	h, err := NewHandlerContext(context.Background(), "mongodb://localhost", "testnewhandlercontextpoollimit", "test", WithPoolLimit(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer h.Close()
+	defer cleanup(h.state.owned, "testnewhandlercontextpoollimit")()
+	// With a single connection, the operations run one after the other
+	assert.True(t, slowOps(h) >= 900*time.Millisecond, "pool limit not enforced")
+	require.NoError(t, h.state.owned.DB("testnewhandlercontextpoollimit").DropDatabase())
+
+	h, err = NewHandlerContext(context.Background(), "mongodb://localhost", "testnewhandlercontextpoollimit", "test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer h.Close()
+	assert.True(t, slowOps(h) < 900*time.Millisecond, "operations not run concurrently")
+}
@@ -0,0 +1,76 @@
+package mongo
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Encrypter encrypts and decrypts field values stored in MongoDB.
+type Encrypter interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// encryptedValue is the bson document holding a field value before encryption.
+type encryptedValue struct {
+	V interface{} `bson:"v"`
+}
+
+// encrypt returns the encrypted form of v as stored in MongoDB.
+func (t translator) encrypt(v interface{}) ([]byte, error) {
+	b, err := bson.Marshal(encryptedValue{V: v})
+	if err != nil {
+		return nil, err
+	}
+	return t.encrypter.Encrypt(b)
+}
+
+// decrypt returns the original value of an encrypted field.
+func (t translator) decrypt(v interface{}) (interface{}, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("invalid encrypted value type: %T", v)
+	}
+	b, err := t.encrypter.Decrypt(b)
+	if err != nil {
+		return nil, err
+	}
+	var ev encryptedValue
+	if err := bson.Unmarshal(b, &ev); err != nil {
+		return nil, err
+	}
+	return ev.V, nil
+}
+
+// encryptPayload encrypts the encrypted fields of p in place.
+func (t translator) encryptPayload(p map[string]interface{}) error {
+	for f := range t.encrypted {
+		v, found := p[f]
+		if !found {
+			continue
+		}
+		ev, err := t.encrypt(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+		p[f] = ev
+	}
+	return nil
+}
+
+// decryptPayload decrypts the encrypted fields of p in place.
+func (t translator) decryptPayload(p map[string]interface{}) error {
+	for f := range t.encrypted {
+		v, found := p[f]
+		if !found {
+			continue
+		}
+		dv, err := t.decrypt(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+		p[f] = dv
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// xorEncrypter is a deterministic (and insecure) Encrypter for tests.
+type xorEncrypter byte
+
+func (e xorEncrypter) Encrypt(b []byte) ([]byte, error) {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[i] = b[i] ^ byte(e)
+	}
+	return r, nil
+}
+
+func (e xorEncrypter) Decrypt(b []byte) ([]byte, error) {
+	return e.Encrypt(b)
+}
+
+func TestFieldEncryptionRoundTrip(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithFieldEncryption([]string{"secret"}, xorEncrypter(42)))
+	item := &resource.Item{
+		ID: "1",
+		Payload: map[string]interface{}{
+			"id":     "1",
+			"secret": "s3cr3t",
+			"public": "foo",
+		},
+	}
+	mItem, err := h.toMongoItem(item)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", mItem.Payload["public"])
+	assert.IsType(t, []byte{}, mItem.Payload["secret"])
+	assert.NotContains(t, string(mItem.Payload["secret"].([]byte)), "s3cr3t")
+	// The original item must be left untouched
+	assert.Equal(t, "s3cr3t", item.Payload["secret"])
+
+	got, err := h.toItem(mItem)
+	require.NoError(t, err)
+	assert.Equal(t, item.Payload, got.Payload)
+}
+
+func TestFieldEncryptionPredicate(t *testing.T) {
+	enc := xorEncrypter(42)
+	tr := translator{encrypted: map[string]bool{"secret": true}, encrypter: enc}
+	ev, err := tr.encrypt("s3cr3t")
+	require.NoError(t, err)
+
+	got, err := tr.translatePredicate(query.MustParsePredicate(`{secret:"s3cr3t"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"secret": ev}, got)
+
+	got, err = tr.translatePredicate(query.MustParsePredicate(`{secret:{$in:["s3cr3t"]}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"secret": bson.M{"$in": []interface{}{ev}}}, got)
+
+	_, err = tr.translatePredicate(query.MustParsePredicate(`{secret:{$gt:"a"}}`))
+	assert.Equal(t, errors.New("secret: encrypted field can only be matched by equality"), err)
+}
+
+func TestFieldEncryption(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfieldencryption")()
+	h := NewHandler(s, "testfieldencryption", "test", WithFieldEncryption([]string{"secret"}, xorEncrypter(42)))
+	ctx := context.Background()
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "secret": "foo"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "secret": "bar"}},
+	}
+	require.NoError(t, h.Insert(ctx, items))
+
+	// Stored value must not be in clear
+	d := bson.M{}
+	require.NoError(t, s.DB("testfieldencryption").C("test").FindId("1").One(&d))
+	assert.NotEqual(t, "foo", d["secret"])
+
+	q, err := query.New("", `{secret:"bar"}`, "", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, map[string]interface{}{"id": "2", "secret": "bar"}, l.Items[0].Payload)
+	}
+}
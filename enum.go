@@ -0,0 +1,78 @@
+package mongo
+
+import "fmt"
+
+// enumMapping holds the integer stored for each string value of an enum field.
+type enumMapping struct {
+	values map[string]int
+	names  map[int]string
+}
+
+// encodeEnum returns the integer stored for the string value v of field.
+func (t translator) encodeEnum(field string, v interface{}) (interface{}, error) {
+	e := t.enums[field]
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid enum value type: %T", field, v)
+	}
+	i, found := e.values[s]
+	if !found {
+		return nil, fmt.Errorf("%s: unknown enum value: %q", field, s)
+	}
+	return i, nil
+}
+
+// decodeEnum returns the string value of the integer v stored for field.
+func (t translator) decodeEnum(field string, v interface{}) (interface{}, error) {
+	e := t.enums[field]
+	var i int
+	switch n := v.(type) {
+	case int:
+		i = n
+	case int32:
+		i = int(n)
+	case int64:
+		i = int(n)
+	default:
+		return nil, fmt.Errorf("%s: invalid stored enum value type: %T", field, v)
+	}
+	s, found := e.names[i]
+	if !found {
+		return nil, fmt.Errorf("%s: unknown stored enum value: %d", field, i)
+	}
+	return s, nil
+}
+
+// encodeEnumPayload replaces the string values of the enum fields of p by
+// their stored integer, in place.
+func (t translator) encodeEnumPayload(p map[string]interface{}) error {
+	for f := range t.enums {
+		v, found := p[f]
+		if !found || v == nil {
+			continue
+		}
+		ev, err := t.encodeEnum(f, v)
+		if err != nil {
+			return err
+		}
+		p[f] = ev
+	}
+	return nil
+}
+
+// decodeEnumPayload replaces the stored integers of the enum fields of p by
+// their string value, in place.
+func (t translator) decodeEnumPayload(p map[string]interface{}) error {
+	for f := range t.enums {
+		v, found := p[f]
+		if !found || v == nil {
+			continue
+		}
+		dv, err := t.decodeEnum(f, v)
+		if err != nil {
+			return err
+		}
+		p[f] = dv
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var statuses = map[string]int{"active": 1, "suspended": 2}
+
+func TestEnumMappingRoundTrip(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithEnumMapping("status", statuses))
+	item := &resource.Item{
+		ID:      "1",
+		Payload: map[string]interface{}{"id": "1", "status": "suspended"},
+	}
+	mItem, err := h.toMongoItem(item)
+	require.NoError(t, err)
+	assert.Equal(t, 2, mItem.Payload["status"])
+	// The original item must be left untouched
+	assert.Equal(t, "suspended", item.Payload["status"])
+
+	// Read back as decoded by mgo
+	b, err := bson.Marshal(mItem)
+	require.NoError(t, err)
+	var back mongoItem
+	require.NoError(t, bson.Unmarshal(b, &back))
+	got, err := h.toItem(&back)
+	require.NoError(t, err)
+	assert.Equal(t, item.Payload, got.Payload)
+
+	_, err = h.toMongoItem(&resource.Item{ID: "2", Payload: map[string]interface{}{"status": "deleted"}})
+	assert.EqualError(t, err, `status: unknown enum value: "deleted"`)
+	_, err = h.toItem(&mongoItem{ID: "2", Payload: map[string]interface{}{"status": 3}})
+	assert.EqualError(t, err, `status: unknown stored enum value: 3`)
+}
+
+func TestEnumMappingPredicate(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithEnumMapping("status", statuses))
+	got, err := h.translatePredicate(query.MustParsePredicate(`{status:"active"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"status": 1}, got)
+
+	got, err = h.translatePredicate(query.MustParsePredicate(`{status:{$in:["active","suspended"]}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"status": bson.M{"$in": []interface{}{1, 2}}}, got)
+
+	_, err = h.translatePredicate(query.MustParsePredicate(`{status:"deleted"}`))
+	assert.EqualError(t, err, `status: unknown enum value: "deleted"`)
+}
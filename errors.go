@@ -0,0 +1,255 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+)
+
+// ErrUnavailable is returned when an operation failed because the database
+// could not be reached or was temporarily unable to serve it, like during a
+// replica set election. Operations failing with this error may be retried.
+var ErrUnavailable = errors.New("database unavailable")
+
+// ErrUnauthorized is reported by Validate when the credentials of the session
+// are rejected or don't grant the permissions the handler needs.
+var ErrUnauthorized = errors.New("not authorized")
+
+// ErrMemoryLimitExceeded is returned when an aggregation or a sort exceeded the
+// memory limit of the server. Setting WithAllowDiskUse lets aggregations use
+// temporary files instead.
+var ErrMemoryLimitExceeded = errors.New("database memory limit exceeded")
+
+// ErrDocumentValidation is returned when a write was rejected by the validator
+// of the collection, like the one set with EnsureSchemaValidator.
+var ErrDocumentValidation = errors.New("document failed validation")
+
+// documentValidationFailure is the MongoDB error code of the writes rejected
+// by the collection validator.
+const documentValidationFailure = 121
+
+// memoryLimitCodes lists the MongoDB error codes reporting an operation
+// exceeding the server memory limit.
+var memoryLimitCodes = map[int]bool{
+	292:   true, // QueryExceededMemoryLimitNoDiskUseAllowed
+	16819: true, // Sort exceeded memory limit
+	16945: true, // Exceeded memory limit for $group
+}
+
+// InsertError is returned by Insert, when the WithUnorderedBulk option is set,
+// if some items could not be inserted. The other items have been inserted.
+type InsertError struct {
+	// Inserted is the number of items inserted.
+	Inserted int
+	// Failures holds the error of each item which could not be inserted,
+	// indexed by its position in the inserted list. Items violating a unique
+	// index, including the id one, fail with resource.ErrConflict.
+	Failures map[int]error
+}
+
+func (e *InsertError) Error() string {
+	return fmt.Sprintf("%d item(s) could not be inserted", len(e.Failures))
+}
+
+// InternalFieldError is returned when a query filters, sorts or groups on one
+// of the fields the handler uses to store the item metadata (etag, _etag and
+// _updated), unless allowed with WithInternalFields.
+type InternalFieldError struct {
+	Field string
+}
+
+func (e *InternalFieldError) Error() string {
+	return fmt.Sprintf("%s: internal field can't be queried", e.Field)
+}
+
+// DocumentSizeError is returned by the write operations when the document of an
+// item exceeds the size set with WithMaxDocumentSize.
+type DocumentSizeError struct {
+	// ID is the id of the rejected item.
+	ID interface{}
+	// Size is the BSON size of the document and Max the limit, in bytes.
+	Size, Max int
+}
+
+func (e *DocumentSizeError) Error() string {
+	return fmt.Sprintf("item %v: document size %d exceeds the limit of %d bytes", e.ID, e.Size, e.Max)
+}
+
+// AggregationError is returned when the server refused to run an aggregation
+// pipeline, used by aggregate queries, computed fields, WithConsistentTotal,
+// GroupCount, DistinctCount and Autocomplete, because it doesn't support it or
+// the user is not allowed to run it. Callers may then fall back to grouping
+// the items themselves. Such errors are not passed to the error mapper.
+type AggregationError struct {
+	Err error
+}
+
+func (e *AggregationError) Error() string {
+	return fmt.Sprintf("aggregation not available: %v", e.Err)
+}
+
+// Unwrap returns the error reported by the server.
+func (e *AggregationError) Unwrap() error {
+	return e.Err
+}
+
+// aggregationCodes lists the MongoDB error codes reporting an aggregation
+// command or stage unsupported by the server.
+var aggregationCodes = map[int]bool{
+	59:    true, // CommandNotFound
+	115:   true, // CommandNotSupported
+	16436: true, // Unrecognized pipeline stage name (before 3.6)
+	40324: true, // Unrecognized pipeline stage name
+}
+
+// isAggregationUnavailable tells if err reports an aggregation the server
+// doesn't support or the user is not allowed to run.
+func isAggregationUnavailable(err error) bool {
+	if isUnauthorized(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		return aggregationCodes[e.Code] || strings.HasPrefix(e.Message, "no such cmd")
+	case *mgo.LastError:
+		return aggregationCodes[e.Code]
+	}
+	return false
+}
+
+// unavailableCodes lists the MongoDB error codes reporting a transient
+// unavailability of the server.
+var unavailableCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// isUnavailable tells if err is a network or server availability error.
+func isUnavailable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case net.Error:
+		return true
+	case *mgo.QueryError:
+		return unavailableCodes[e.Code]
+	case *mgo.LastError:
+		return unavailableCodes[e.Code]
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	// mgo reports those errors without a dedicated type
+	switch err.Error() {
+	case "no reachable servers", "server not available", "Closed explicitly":
+		return true
+	}
+	return false
+}
+
+// isUnauthorized tells if err reports missing permissions or rejected
+// credentials.
+func isUnauthorized(err error) bool {
+	var code int
+	var msg string
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		code, msg = e.Code, e.Message
+	case *mgo.LastError:
+		code, msg = e.Code, e.Err
+	default:
+		return false
+	}
+	// Unauthorized and AuthenticationFailed; old servers set no code
+	return code == 13 || code == 18 || strings.HasPrefix(msg, "not authorized")
+}
+
+// isMemoryLimit tells if err reports an exceeded server memory limit.
+func isMemoryLimit(err error) bool {
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		return memoryLimitCodes[e.Code]
+	case *mgo.LastError:
+		return memoryLimitCodes[e.Code]
+	}
+	return false
+}
+
+// mapPipeError maps the error err of an aggregation pipeline, reporting an
+// aggregation refused by the server with an *AggregationError.
+func (m Handler) mapPipeError(err error) error {
+	if isAggregationUnavailable(err) {
+		return &AggregationError{Err: err}
+	}
+	return m.mapError(err)
+}
+
+// isNamespaceNotFound tells if err reports a collection which doesn't exist.
+func isNamespaceNotFound(err error) bool {
+	qErr, ok := err.(*mgo.QueryError)
+	// NamespaceNotFound; old servers set no code
+	return ok && (qErr.Code == 26 || qErr.Message == "ns missing" || qErr.Message == "ns does not exist")
+}
+
+// isCursorNotFound tells if err reports a cursor killed by the server, for
+// instance after it timed out or the server restarted.
+func isCursorNotFound(err error) bool {
+	if err == mgo.ErrCursor {
+		return true
+	}
+	// CursorNotFound
+	qErr, ok := err.(*mgo.QueryError)
+	return ok && qErr.Code == 43
+}
+
+// isDocumentValidation tells if err reports a write rejected by the collection
+// validator.
+func isDocumentValidation(err error) bool {
+	switch e := err.(type) {
+	case *mgo.QueryError:
+		return e.Code == documentValidationFailure
+	case *mgo.LastError:
+		return e.Code == documentValidationFailure
+	}
+	return false
+}
+
+// DefaultErrorMapper is the error mapper used unless WithErrorMapper is set.
+// It translates network and server availability errors to ErrUnavailable,
+// exceeded memory limit errors to ErrMemoryLimitExceeded and returns other
+// errors unchanged.
+func DefaultErrorMapper(err error) error {
+	if isUnavailable(err) {
+		return ErrUnavailable
+	}
+	if isMemoryLimit(err) {
+		return ErrMemoryLimitExceeded
+	}
+	if isDocumentValidation(err) {
+		return ErrDocumentValidation
+	}
+	return err
+}
+
+// mapError translates the errors returned by mgo into the handler errors.
+func (m Handler) mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if m.errorMapper != nil {
+		return m.errorMapper(err)
+	}
+	return DefaultErrorMapper(err)
+}
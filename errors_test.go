@@ -0,0 +1,103 @@
+package mongo
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+)
+
+func TestMapError(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	cases := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"nil", nil, nil},
+		{"net", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, ErrUnavailable},
+		{"eof", io.EOF, ErrUnavailable},
+		{"no servers", errors.New("no reachable servers"), ErrUnavailable},
+		{"not master", &mgo.QueryError{Code: 10107, Message: "not master"}, ErrUnavailable},
+		{"stepped down", &mgo.LastError{Code: 189, Err: "primary stepped down"}, ErrUnavailable},
+		{"group memory", &mgo.QueryError{Code: 16945, Message: "Exceeded memory limit for $group"}, ErrMemoryLimitExceeded},
+		{"sort memory", &mgo.QueryError{Code: 16819, Message: "Sort exceeded memory limit"}, ErrMemoryLimitExceeded},
+		{"validation", &mgo.QueryError{Code: 121, Message: "Document failed validation"}, ErrDocumentValidation},
+		{"validation write", &mgo.LastError{Code: 121, Err: "Document failed validation"}, ErrDocumentValidation},
+		{"query", &mgo.QueryError{Code: 2, Message: "bad value"}, &mgo.QueryError{Code: 2, Message: "bad value"}},
+		{"not found", resource.ErrNotFound, resource.ErrNotFound},
+		{"conflict", resource.ErrConflict, resource.ErrConflict},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, h.mapError(tc.err))
+		})
+	}
+}
+
+func TestErrorMapper(t *testing.T) {
+	errCustom := errors.New("custom")
+	h := NewHandler(&mgo.Session{}, "db", "test", WithErrorMapper(func(err error) error {
+		if e, ok := err.(*mgo.QueryError); ok && e.Code == 2 {
+			return errCustom
+		}
+		return DefaultErrorMapper(err)
+	}))
+	assert.Equal(t, errCustom, h.mapError(&mgo.QueryError{Code: 2, Message: "bad value"}))
+	assert.Equal(t, &mgo.QueryError{Code: 3, Message: "other"}, h.mapError(&mgo.QueryError{Code: 3, Message: "other"}))
+	assert.Equal(t, ErrUnavailable, h.mapError(io.EOF))
+	assert.NoError(t, h.mapError(nil))
+}
+
+func TestMapPipeError(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	cases := []struct {
+		name string
+		err  error
+		agg  bool
+	}{
+		{"no such command", &mgo.QueryError{Code: 59, Message: "no such cmd: aggregate"}, true},
+		{"no such command without code", &mgo.QueryError{Message: "no such cmd: aggregate"}, true},
+		{"not supported", &mgo.QueryError{Code: 115, Message: "aggregate is not supported"}, true},
+		{"unknown stage", &mgo.QueryError{Code: 40324, Message: "Unrecognized pipeline stage name: '$facet'"}, true},
+		{"unauthorized", &mgo.QueryError{Code: 13, Message: "not authorized on db to execute command { aggregate: \"test\" }"}, true},
+		{"unavailable", io.EOF, false},
+		{"query", &mgo.QueryError{Code: 2, Message: "bad value"}, false},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			err := h.mapPipeError(tc.err)
+			if !tc.agg {
+				assert.Equal(t, h.mapError(tc.err), err)
+				return
+			}
+			if aErr, ok := err.(*AggregationError); assert.True(t, ok, "got %v", err) {
+				assert.Equal(t, tc.err, aErr.Err)
+				assert.True(t, errors.Is(err, tc.err))
+				assert.EqualError(t, err, "aggregation not available: "+tc.err.Error())
+			}
+		})
+	}
+}
+
+func TestIsNamespaceNotFound(t *testing.T) {
+	assert.True(t, isNamespaceNotFound(&mgo.QueryError{Code: 26, Message: "ns does not exist"}))
+	assert.True(t, isNamespaceNotFound(&mgo.QueryError{Message: "ns missing"}))
+	assert.False(t, isNamespaceNotFound(&mgo.QueryError{Code: 2, Message: "bad value"}))
+	assert.False(t, isNamespaceNotFound(io.EOF))
+	assert.False(t, isNamespaceNotFound(nil))
+}
+
+func TestIsCursorNotFound(t *testing.T) {
+	assert.True(t, isCursorNotFound(mgo.ErrCursor))
+	assert.True(t, isCursorNotFound(&mgo.QueryError{Code: 43, Message: "cursor id 123 not found"}))
+	assert.False(t, isCursorNotFound(&mgo.QueryError{Code: 2, Message: "bad value"}))
+	assert.False(t, isCursorNotFound(io.EOF))
+	assert.False(t, isCursorNotFound(nil))
+}
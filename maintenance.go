@@ -0,0 +1,243 @@
+package mongo
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Reindex drops and rebuilds all the indexes of the collection using the
+// reIndex command. Note that the collection is locked for the whole duration
+// of the operation, which can be long on large collections.
+func (m Handler) Reindex(ctx context.Context) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	err = c.Database.Run(bson.D{{Name: "reIndex", Value: c.Name}}, nil)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return m.mapError(err)
+}
+
+// Compact rewrites and defragments the data and indexes of the collection
+// using the compact command, to reclaim the disk space freed by large deletes.
+// The command blocks the operations on the whole database while running (on
+// MongoDB before 4.4), and storage engines may not release the reclaimed space
+// to the operating system, in which case it only makes it available for reuse.
+// It has no effect on in-memory storage engines.
+func (m Handler) Compact(ctx context.Context) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	err = c.Database.Run(bson.D{{Name: "compact", Value: c.Name}}, nil)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return m.mapError(err)
+}
+
+// EnsureSharding enables sharding on the database of the collection and shards
+// the collection on the given shard key fields (using ranged sharding), doing
+// nothing if already done. The id field stands for the item id. The commands
+// must be run against a mongos router by a user allowed to run the
+// enableSharding and shardCollection admin commands, like one granted the
+// clusterManager role. Use WithShardKey for a key other than the id alone.
+func (m Handler) EnsureSharding(ctx context.Context, key ...string) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if len(key) == 0 {
+		return errors.New("empty shard key")
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	admin := c.Database.Session.DB("admin")
+	err = admin.Run(bson.D{{Name: "enableSharding", Value: c.Database.Name}}, nil)
+	if qErr, ok := err.(*mgo.QueryError); ok && qErr.Code == 23 {
+		// AlreadyInitialized: sharding is already enabled on the database
+		err = nil
+	}
+	if err == nil {
+		k := bson.D{}
+		for _, f := range key {
+			k = append(k, bson.DocElem{Name: getField(f), Value: 1})
+		}
+		err = admin.Run(bson.D{{Name: "shardCollection", Value: c.FullName}, {Name: "key", Value: k}}, nil)
+		if err != nil && strings.Contains(err.Error(), "already sharded") {
+			err = nil
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return m.mapError(err)
+}
+
+// validationLevels and validationActions list the accepted validation levels
+// and actions of EnsureSchemaValidator.
+var (
+	validationLevels  = map[string]bool{"": true, "off": true, "strict": true, "moderate": true}
+	validationActions = map[string]bool{"": true, "error": true, "warn": true}
+)
+
+// EnsureSchemaValidator sets schema as the $jsonSchema validator of the
+// collection, creating it if it doesn't exist yet, so the server rejects the
+// invalid documents. Writes of such documents then fail with
+// ErrDocumentValidation. level (off, strict or moderate) tells which writes
+// are validated and action (error or warn) whether invalid documents are
+// rejected or only logged; empty values keep the server defaults (strict and
+// error). Note that the schema applies to the stored documents, whose id is
+// stored as _id along with the _etag and _updated fields.
+func (m Handler) EnsureSchemaValidator(ctx context.Context, schema bson.M, level, action string) error {
+	if len(schema) == 0 {
+		return errors.New("empty schema")
+	}
+	if !validationLevels[level] {
+		return fmt.Errorf("invalid validation level %q", level)
+	}
+	if !validationActions[action] {
+		return fmt.Errorf("invalid validation action %q", action)
+	}
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	opts := bson.D{{Name: "validator", Value: bson.M{"$jsonSchema": schema}}}
+	if level != "" {
+		opts = append(opts, bson.DocElem{Name: "validationLevel", Value: level})
+	}
+	if action != "" {
+		opts = append(opts, bson.DocElem{Name: "validationAction", Value: action})
+	}
+	collMod := append(bson.D{{Name: "collMod", Value: c.Name}}, opts...)
+	err = c.Database.Run(collMod, nil)
+	if isNamespaceNotFound(err) {
+		// Create the collection with the validator
+		err = c.Database.Run(append(bson.D{{Name: "create", Value: c.Name}}, opts...), nil)
+		if qErr, ok := err.(*mgo.QueryError); ok && qErr.Code == 48 {
+			// NamespaceExists: created concurrently
+			err = c.Database.Run(collMod, nil)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return m.mapError(err)
+}
+
+// BackfillETags sets the _etag field of the documents stored without one, like
+// those inserted before the handler was used, which otherwise get a "p-[id]"
+// etag and are updated without concurrency control. The etag is a hash of the
+// document content. Documents are processed by batches of batchSize, ctx being
+// checked between batches, and the number of documents updated is returned.
+//
+// As backfilling is a long running operation, the WithDefaultTimeout option
+// does not apply.
+func (m Handler) BackfillETags(ctx context.Context, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, fmt.Errorf("invalid batch size %d: must be positive", batchSize)
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close(c)
+	missing := bson.M{"_etag": bson.M{"$exists": false}}
+	updated := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+		var docs []bson.M
+		if err := c.Find(missing).Limit(batchSize).All(&docs); err != nil {
+			return updated, m.mapError(err)
+		}
+		for _, doc := range docs {
+			raw, err := bson.Marshal(doc)
+			if err != nil {
+				return updated, err
+			}
+			etag := fmt.Sprintf("%x", md5.Sum(raw))
+			err = c.Update(bson.M{"_id": doc["_id"], "_etag": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"_etag": etag}})
+			if err == mgo.ErrNotFound {
+				// Updated concurrently
+				continue
+			}
+			if err != nil {
+				return updated, m.mapError(err)
+			}
+			updated++
+		}
+		if len(docs) < batchSize {
+			return updated, nil
+		}
+	}
+}
+
+// RenameField renames the from field to to in all the documents of the
+// collection using the $rename update operator, for instance during a schema
+// migration, and returns the number of documents modified. The id field and
+// the fields storing the item metadata can't be renamed. An existing to field
+// is overwritten. The renamed documents get a new etag, so the clients holding
+// their previous version can't update them based on it.
+func (m Handler) RenameField(ctx context.Context, from, to string) (int, error) {
+	for _, f := range []string{from, to} {
+		if f == "" || getField(f) == "_id" || internalFields[f] {
+			return 0, fmt.Errorf("invalid field %q: can't be renamed", f)
+		}
+	}
+	if from == to {
+		return 0, fmt.Errorf("invalid field %q: renamed to itself", from)
+	}
+	u, err := renameUpdate(from, to)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close(c)
+	info, err := c.UpdateAll(bson.M{from: bson.M{"$exists": true}}, u)
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		return 0, m.mapError(err)
+	}
+	return info.Updated, nil
+}
+
+// renameUpdate returns the update renaming the from field to to and setting a
+// new etag.
+func renameUpdate(from, to string) (bson.M, error) {
+	etag, err := newETag()
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{
+		"$rename": bson.M{from: to},
+		"$set":    bson.M{"_etag": etag},
+	}, nil
+}
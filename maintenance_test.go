@@ -0,0 +1,235 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReindex(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testreindex")()
+	h := NewHandler(s, "testreindex", "test")
+	ctx := context.Background()
+	items := make([]*resource.Item, 100)
+	for i := range items {
+		id := fmt.Sprint(i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}}
+	}
+	require.NoError(t, h.Insert(ctx, items))
+	require.NoError(t, s.DB("testreindex").C("test").EnsureIndexKey("n"))
+
+	assert.NoError(t, h.Reindex(ctx))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, h.Reindex(canceled))
+}
+
+func TestCompact(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testcompact")()
+	h := NewHandler(s, "testcompact", "test")
+	ctx := context.Background()
+	items := make([]*resource.Item, 100)
+	for i := range items {
+		id := fmt.Sprint(i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}}
+	}
+	require.NoError(t, h.Insert(ctx, items))
+	_, err = h.Clear(ctx, &query.Query{})
+	require.NoError(t, err)
+
+	assert.NoError(t, h.Compact(ctx))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, context.Canceled, h.Compact(canceled))
+}
+
+func TestEnsureSharding(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if err := s.Run("isdbgrid", nil); err != nil {
+		t.Skip("skipping test: not connected to a mongos router.")
+	}
+	defer cleanup(s, "testensuresharding")()
+	h := NewHandler(s, "testensuresharding", "test", WithShardKey([]string{"tenant"}))
+	ctx := context.Background()
+	require.NoError(t, h.EnsureSharding(ctx, "tenant", "id"))
+	// Running it again is harmless
+	require.NoError(t, h.EnsureSharding(ctx, "tenant", "id"))
+
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "tenant": "t1", "foo": "bar"}}
+	require.NoError(t, h.Insert(ctx, []*resource.Item{item}))
+	newItem := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "tenant": "t1", "foo": "baz"}}
+	assert.NoError(t, h.Update(ctx, newItem, item))
+	assert.NoError(t, h.Delete(ctx, newItem))
+
+	assert.EqualError(t, h.EnsureSharding(ctx), "empty shard key")
+}
+
+func TestBackfillETags(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testbackfilletags")()
+	h := NewHandler(s, "testbackfilletags", "test")
+	ctx := context.Background()
+	c := s.DB("testbackfilletags").C("test")
+	for i := 0; i < 25; i++ {
+		require.NoError(t, c.Insert(bson.M{"_id": fmt.Sprint(i), "n": i}))
+	}
+	require.NoError(t, h.Insert(ctx, []*resource.Item{{ID: "a", ETag: "e", Payload: map[string]interface{}{"id": "a"}}}))
+
+	n, err := h.BackfillETags(ctx, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 25, n)
+	missing, err := c.Find(bson.M{"_etag": bson.M{"$exists": false}}).Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, missing)
+
+	l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.NotContains(t, l.Items[0].ETag, "p-")
+	l, err = h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:"a"}`)})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, "e", l.Items[0].ETag)
+
+	n, err = h.BackfillETags(ctx, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = h.BackfillETags(canceled, 10)
+	assert.Equal(t, context.Canceled, err)
+	_, err = h.BackfillETags(ctx, 0)
+	assert.Error(t, err)
+}
+
+func TestRenameField(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testrenamefield")()
+	h := NewHandler(s, "testrenamefield", "test")
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "foo"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "bar"}},
+		{ID: "3", ETag: "c", Payload: map[string]interface{}{"id": "3", "other": "baz"}},
+	}))
+
+	n, err := h.RenameField(ctx, "name", "title")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:"1"}`)})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, map[string]interface{}{"id": "1", "title": "foo"}, l.Items[0].Payload)
+	assert.NotEqual(t, "a", l.Items[0].ETag)
+	l, err = h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{id:"3"}`)})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, map[string]interface{}{"id": "3", "other": "baz"}, l.Items[0].Payload)
+	assert.Equal(t, "c", l.Items[0].ETag)
+
+	n, err = h.RenameField(ctx, "name", "title")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, err = h.RenameField(ctx, "id", "key")
+	assert.EqualError(t, err, `invalid field "id": can't be renamed`)
+	_, err = h.RenameField(ctx, "title", "_etag")
+	assert.EqualError(t, err, `invalid field "_etag": can't be renamed`)
+	_, err = h.RenameField(ctx, "title", "title")
+	assert.EqualError(t, err, `invalid field "title": renamed to itself`)
+}
+
+func TestRenameUpdate(t *testing.T) {
+	u, err := renameUpdate("name", "title")
+	require.NoError(t, err)
+	assert.Equal(t, bson.M{"name": "title"}, u["$rename"])
+	etag := u["$set"].(bson.M)["_etag"]
+	assert.Len(t, etag, 32)
+	u, err = renameUpdate("name", "title")
+	require.NoError(t, err)
+	assert.NotEqual(t, etag, u["$set"].(bson.M)["_etag"])
+}
+
+func TestEnsureSchemaValidatorInvalid(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	ctx := context.Background()
+	schema := bson.M{"required": []string{"name"}}
+	assert.EqualError(t, h.EnsureSchemaValidator(ctx, nil, "", ""), "empty schema")
+	assert.EqualError(t, h.EnsureSchemaValidator(ctx, schema, "lax", ""), `invalid validation level "lax"`)
+	assert.EqualError(t, h.EnsureSchemaValidator(ctx, schema, "", "ignore"), `invalid validation action "ignore"`)
+}
+
+func TestEnsureSchemaValidator(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if bi, err := s.BuildInfo(); err != nil || !bi.VersionAtLeast(3, 6) {
+		t.Skip("skipping test: $jsonSchema requires MongoDB 3.6+.")
+	}
+	defer cleanup(s, "testensureschemavalidator")()
+	h := NewHandler(s, "testensureschemavalidator", "test")
+	ctx := context.Background()
+	schema := bson.M{
+		"bsonType": "object",
+		"required": []string{"name"},
+		"properties": bson.M{
+			"name": bson.M{"bsonType": "string"},
+		},
+	}
+	// Creates the collection
+	require.NoError(t, h.EnsureSchemaValidator(ctx, schema, "strict", "error"))
+	// Updates the validator of the existing collection
+	require.NoError(t, h.EnsureSchemaValidator(ctx, schema, "", ""))
+
+	assert.NoError(t, h.Insert(ctx, []*resource.Item{{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "foo"}}}))
+	err = h.Insert(ctx, []*resource.Item{{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "name": 42}}})
+	assert.Equal(t, ErrDocumentValidation, err)
+	err = h.Insert(ctx, []*resource.Item{{ID: "3", ETag: "a", Payload: map[string]interface{}{"id": "3"}}})
+	assert.Equal(t, ErrDocumentValidation, err)
+}
@@ -3,8 +3,12 @@ package mongo
 
 import (
 	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/oktacode/rest-layer/resource"
@@ -19,14 +23,18 @@ type mongoItem struct {
 	ETag    string                 `bson:"_etag"`
 	Updated time.Time              `bson:"_updated"`
 	Payload map[string]interface{} `bson:",inline"`
+	// order, when set, lists the payload fields to store first, in order.
+	order []string `bson:"-"`
 }
 
 // newMongoItem converts a resource.Item into a mongoItem.
 func newMongoItem(i *resource.Item) *mongoItem {
-	// Filter out id from the payload so we don't store it twice
+	// Filter out id from the payload so we don't store it twice. The item ID
+	// is authoritative, so a stray _id key in the payload is dropped as well
+	// as it would collide with the storage primary key.
 	p := map[string]interface{}{}
 	for k, v := range i.Payload {
-		if k != "id" {
+		if k != "id" && k != "_id" {
 			p[k] = v
 		}
 	}
@@ -46,6 +54,8 @@ func newItem(i *mongoItem) *resource.Item {
 		i.Payload = make(map[string]interface{})
 	}
 	// Add the id back (we use the same map hoping the mongoItem won't be stored back)
+	// and make sure the storage only _id never leaks into the payload.
+	delete(i.Payload, "_id")
 	i.Payload["id"] = i.ID
 	item := &resource.Item{
 		ID:      i.ID,
@@ -64,17 +74,369 @@ func newItem(i *mongoItem) *resource.Item {
 	return item
 }
 
+// toMongoItem converts a resource.Item into a mongoItem according to the
+// handler settings.
+func (m Handler) toMongoItem(i *resource.Item) (*mongoItem, error) {
+	mItem := newMongoItem(i)
+	id, err := m.encodeID(mItem.ID)
+	if err != nil {
+		return nil, err
+	}
+	mItem.ID = id
+	mItem.order = m.fieldOrder
+	if m.timePrecision > 0 {
+		mItem.Updated = mItem.Updated.Truncate(m.timePrecision)
+	}
+	if err := m.encodeEnumPayload(mItem.Payload); err != nil {
+		return nil, err
+	}
+	if err := m.encodeTimestampPayload(mItem.Payload); err != nil {
+		return nil, err
+	}
+	if err := m.encryptPayload(mItem.Payload); err != nil {
+		return nil, err
+	}
+	if m.maxDocumentSize > 0 {
+		raw, err := bson.Marshal(mItem)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw) > m.maxDocumentSize {
+			return nil, &DocumentSizeError{ID: i.ID, Size: len(raw), Max: m.maxDocumentSize}
+		}
+	}
+	return mItem, nil
+}
+
+// contentETag returns an etag hashing the content of i, used for the items
+// built from aggregation results, which are not stored with an etag. The
+// payload fields are hashed in a stable order so equal items get equal etags.
+func contentETag(i mongoItem) (string, error) {
+	i.order = []string{}
+	raw, err := bson.Marshal(i)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum(raw)), nil
+}
+
+// toItem converts back a mongoItem into a resource.Item according to the
+// handler settings.
+func (m Handler) toItem(i *mongoItem) (*resource.Item, error) {
+	id, err := m.decodeID(i.ID)
+	if err != nil {
+		return nil, err
+	}
+	i.ID = id
+	if err := m.decryptPayload(i.Payload); err != nil {
+		return nil, err
+	}
+	if err := m.decodeEnumPayload(i.Payload); err != nil {
+		return nil, err
+	}
+	if err := m.decodeTimestampPayload(i.Payload); err != nil {
+		return nil, err
+	}
+	return newItem(i), nil
+}
+
+// ErrClosed is returned by the operations of a closed handler.
+var ErrClosed = errors.New("mongo handler closed")
+
+// handlerState is the state shared by all the copies of a Handler.
+type handlerState struct {
+	mu     sync.Mutex
+	closed bool
+	// owned is the session dialed by the handler, if any.
+	owned *mgo.Session
+}
+
+// HandlerFunc returns the collection to work on for a context. It is the
+// former Handler type, converted to a Handler by NewHandlerFunc.
+type HandlerFunc func(ctx context.Context) (*mgo.Collection, error)
+
 // Handler handles resource storage in a MongoDB collection.
-type Handler func(ctx context.Context) (*mgo.Collection, error)
+type Handler struct {
+	translator
+	state      *handlerState
+	collection HandlerFunc
+	maxOffset  int
+	// currentDate makes Update use the server date for _updated.
+	currentDate bool
+	// timePrecision is the granularity _updated is truncated to on write.
+	timePrecision time.Duration
+	// defaultTimeout is applied to operations whose context has no deadline.
+	defaultTimeout time.Duration
+	// computed holds the $addFields stage expressions used by Find.
+	computed bson.M
+	// collation is applied to Find and Count when set.
+	collation *Collation
+	// upsert makes Update insert the item if not stored yet, setting its
+	// createdField, if any, on insertion only.
+	upsert       bool
+	createdField string
+	// prefetch overrides the mgo prefetch ratio of Find cursors when set.
+	prefetch *float64
+	// noCursorTimeout disables the server timeout of FindEach cursors.
+	noCursorTimeout bool
+	// mutationHook is called after the successful writes when set.
+	mutationHook func(op string, ids []interface{})
+	// cursorRetry runs again the queries whose cursor was killed.
+	cursorRetry bool
+	// exactTotal makes Find count the matching items when a window is set.
+	exactTotal bool
+	// unorderedBulk makes Insert continue past failing items.
+	unorderedBulk bool
+	// shardKey lists the shard key fields added to write selectors.
+	shardKey []string
+	// poolLimit bounds the connection pool of the sessions dialed by the
+	// handler.
+	poolLimit int
+	// tailAwaitTime is the time Tail cursors wait for new items.
+	tailAwaitTime time.Duration
+	// unwind lists the array fields flattened before grouping.
+	unwind []string
+	// allowDiskUse lets aggregations write temporary files.
+	allowDiskUse bool
+	// errorMapper replaces DefaultErrorMapper when set.
+	errorMapper func(error) error
+	// readMode and readTags select the members Find and Count read from.
+	readMode mgo.Mode
+	readTags []bson.D
+	// fieldOrder lists the fields stored first, in order.
+	fieldOrder []string
+	// versionField is the field used for optimistic locking instead of the
+	// etag when set.
+	versionField string
+	// consistentTotal makes Find use $facet to count the total.
+	consistentTotal bool
+	// updatedPrecondition adds the update date of the original item to the
+	// write selectors.
+	updatedPrecondition bool
+	// requirePredicateOnClear rejects the clears without filter.
+	requirePredicateOnClear bool
+	// maxDocumentSize limits the BSON size of the written documents.
+	maxDocumentSize int
+	// maxScan limits the number of documents examined by finds.
+	maxScan int
+	// logger receives the diagnostic logs when set.
+	logger func(level, msg string, kv ...interface{})
+	// err is set by invalid options.
+	err error
+}
 
-// NewHandler creates an new mongo handler
-func NewHandler(s *mgo.Session, db, collection string) Handler {
+// NewHandler creates an new mongo handler. If db or collection are not valid
+// MongoDB names, all the operations of the returned handler fail with a
+// *NameError. Use NewHandlerE to get the error upfront.
+func NewHandler(s *mgo.Session, db, collection string, opts ...Option) Handler {
+	if err := validateNames(db, collection); err != nil {
+		return NewHandlerFunc(func(ctx context.Context) (*mgo.Collection, error) {
+			return nil, err
+		}, opts...)
+	}
 	c := func() *mgo.Collection {
 		return s.DB(db).C(collection)
 	}
-	return func(ctx context.Context) (*mgo.Collection, error) {
+	return NewHandlerFunc(func(ctx context.Context) (*mgo.Collection, error) {
 		return c(), nil
+	}, opts...)
+}
+
+// NewHandlerE works like NewHandler but returns the *NameError of an invalid db
+// or collection name, or the error of an invalid option, instead of a handler
+// whose operations all fail with it.
+func NewHandlerE(s *mgo.Session, db, collection string, opts ...Option) (Handler, error) {
+	if err := validateNames(db, collection); err != nil {
+		return Handler{}, err
+	}
+	h := NewHandler(s, db, collection, opts...)
+	if h.err != nil {
+		return Handler{}, h.err
+	}
+	return h, nil
+}
+
+// NewHandlerFunc creates a new mongo handler getting the collection to work on
+// from f for each operation. This can be used to select the collection based
+// on the context.
+func NewHandlerFunc(f HandlerFunc, opts ...Option) Handler {
+	h := Handler{state: &handlerState{}, collection: f}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	if h.err != nil {
+		// Report invalid options on use
+		err := h.err
+		h.collection = func(ctx context.Context) (*mgo.Collection, error) {
+			return nil, err
+		}
+	}
+	return h
+}
+
+// NewHandlers creates a mongo handler for each of the given collections of
+// db. All the handlers share the same session, and thus its connection pool,
+// so a single mgo.Dial is needed for the whole set of resources.
+func NewHandlers(s *mgo.Session, db string, collections []string, opts ...Option) map[string]Handler {
+	handlers := make(map[string]Handler, len(collections))
+	for _, collection := range collections {
+		handlers[collection] = NewHandler(s, db, collection, opts...)
+	}
+	return handlers
+}
+
+// WithDatabase returns a copy of the handler working on the same collection
+// but in the db database, for instance to isolate tenants by database. The
+// copy shares the session, and thus the connection pool, of the handler.
+func (m Handler) WithDatabase(db string) Handler {
+	f := m.collection
+	if err := validateDBName(db); err != nil {
+		m.collection = func(ctx context.Context) (*mgo.Collection, error) {
+			return nil, err
+		}
+		return m
+	}
+	m.collection = func(ctx context.Context) (*mgo.Collection, error) {
+		c, err := f(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.Database.Session.DB(db).C(c.Name), nil
+	}
+	return m
+}
+
+// context returns ctx with the default timeout applied if it has no deadline.
+func (m Handler) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.defaultTimeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			return context.WithTimeout(ctx, m.defaultTimeout)
+		}
 	}
+	return ctx, func() {}
+}
+
+// journaledKey is the context key marking the operations to journal.
+type journaledKey struct{}
+
+// Journaled returns a copy of ctx making the writes performed with it wait for
+// their commit to the journal of the server (j:true write concern) before
+// returning, for critical operations which must survive a server crash. This
+// includes the writes run as commands, which set the write concern themselves.
+// Other operations keep the default write concern of the session.
+func Journaled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, journaledKey{}, true)
+}
+
+// unfilteredClearKey is the context key allowing clears without filter.
+type unfilteredClearKey struct{}
+
+// AllowUnfilteredClear returns a copy of ctx allowing Clear and ClearProgress
+// to delete all the items of the collection despite WithRequirePredicateOnClear.
+func AllowUnfilteredClear(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unfilteredClearKey{}, true)
+}
+
+// checkClearFilter returns ErrUnfilteredClear if the Mongo query qry of a clear
+// matches all the items while WithRequirePredicateOnClear is set and ctx
+// doesn't allow it.
+func (m Handler) checkClearFilter(ctx context.Context, qry bson.M) error {
+	if !m.requirePredicateOnClear {
+		return nil
+	}
+	if allowed, _ := ctx.Value(unfilteredClearKey{}).(bool); allowed {
+		return nil
+	}
+	for k := range qry {
+		// A comment doesn't filter anything
+		if k != "$comment" {
+			return nil
+		}
+	}
+	return ErrUnfilteredClear
+}
+
+// safe returns the minimal safety mode of the operations performed with ctx.
+func safe(ctx context.Context) *mgo.Safe {
+	if j, _ := ctx.Value(journaledKey{}).(bool); j {
+		return &mgo.Safe{J: true}
+	}
+	return &mgo.Safe{}
+}
+
+// journaled tells if the writes performed with ctx must be journaled.
+func journaled(ctx context.Context) bool {
+	return safe(ctx).J
+}
+
+// writeConcern returns the write concern to set on the write commands run with
+// ctx, as commands ignore the safe mode of the session, or nil to keep the
+// server default.
+func writeConcern(ctx context.Context) bson.M {
+	if journaled(ctx) {
+		return bson.M{"j": true}
+	}
+	return nil
+}
+
+// findModifyCmd is the findAndModify command run by apply.
+type findModifyCmd struct {
+	Collection   string      `bson:"findAndModify"`
+	Query        interface{} `bson:"query"`
+	Update       interface{} `bson:"update"`
+	Fields       interface{} `bson:"fields,omitempty"`
+	Upsert       bool        `bson:"upsert,omitempty"`
+	New          bool        `bson:"new,omitempty"`
+	WriteConcern bson.M      `bson:"writeConcern,omitempty"`
+}
+
+// apply works like mgo.Query.Apply on the documents of c matching s, selecting
+// fields, but also applies the write concern of ctx, which Apply ignores.
+func apply(ctx context.Context, c *mgo.Collection, s bson.M, fields bson.M, change mgo.Change, result interface{}) (*mgo.ChangeInfo, error) {
+	wc := writeConcern(ctx)
+	if wc == nil {
+		return c.Find(s).Select(fields).Apply(change, result)
+	}
+	cmd := findModifyCmd{
+		Collection:   c.Name,
+		Query:        s,
+		Update:       change.Update,
+		Fields:       fields,
+		Upsert:       change.Upsert,
+		New:          change.ReturnNew,
+		WriteConcern: wc,
+	}
+	var r struct {
+		Value     bson.Raw `bson:"value"`
+		LastError struct {
+			N               int         `bson:"n"`
+			UpdatedExisting bool        `bson:"updatedExisting"`
+			Upserted        interface{} `bson:"upserted"`
+		} `bson:"lastErrorObject"`
+	}
+	if err := c.Database.Run(cmd, &r); err != nil {
+		if qErr, ok := err.(*mgo.QueryError); ok && qErr.Message == "No matching object found" {
+			return nil, mgo.ErrNotFound
+		}
+		return nil, err
+	}
+	if r.LastError.N == 0 {
+		return nil, mgo.ErrNotFound
+	}
+	if r.Value.Kind != 0x0A && result != nil {
+		// 0x0A is the BSON null returned when no document is returned
+		if err := r.Value.Unmarshal(result); err != nil {
+			return nil, err
+		}
+	}
+	info := &mgo.ChangeInfo{}
+	if r.LastError.UpdatedExisting {
+		info.Updated = r.LastError.N
+		info.Matched = r.LastError.N
+	} else if change.Upsert {
+		info.UpsertedId = r.LastError.Upserted
+	}
+	return info, nil
 }
 
 // C returns the mongo collection managed by this storage handler
@@ -83,14 +445,17 @@ func (m Handler) c(ctx context.Context) (*mgo.Collection, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	c, err := m(ctx)
+	if m.closed() {
+		return nil, ErrClosed
+	}
+	c, err := m.collection(ctx)
 	if err != nil {
 		return nil, err
 	}
 	// With mgo, session.Copy() pulls a connection from the connection pool
 	s := c.Database.Session.Copy()
 	// Ensure safe mode is enabled in order to get errors
-	s.EnsureSafe(&mgo.Safe{})
+	s.EnsureSafe(safe(ctx))
 	// Set a timeout to match the context deadline if any
 	if deadline, ok := ctx.Deadline(); ok {
 		timeout := deadline.Sub(time.Now())
@@ -101,29 +466,135 @@ func (m Handler) c(ctx context.Context) (*mgo.Collection, error) {
 		s.SetSyncTimeout(timeout)
 	}
 	c.Database.Session = s
+	m.log("debug", "session acquired", "collection", c.FullName)
 	return c, nil
 }
 
+// groupPipeline returns the aggregation pipeline grouping the documents
+// matching qry with grp, after unwinding the array fields set by WithUnwind.
+func (m Handler) groupPipeline(qry, grp bson.M) []bson.M {
+	pipeline := []bson.M{bson.M{"$match": qry}}
+	for _, f := range m.unwind {
+		pipeline = append(pipeline, bson.M{"$unwind": "$" + getField(f)})
+	}
+	return append(pipeline, bson.M{"$group": grp})
+}
+
+// pipe prepares the aggregation pipeline to run on c.
+func (m Handler) pipe(c *mgo.Collection, pipeline interface{}) *mgo.Pipe {
+	p := c.Pipe(pipeline)
+	if m.allowDiskUse {
+		p = p.AllowDiskUse()
+	}
+	return p
+}
+
+// checkWindow ensures the query window stays within the configured limits.
+func (m Handler) checkWindow(w *query.Window) error {
+	if w != nil && m.maxOffset > 0 && w.Offset > m.maxOffset {
+		return ErrMaxOffsetExceeded
+	}
+	return nil
+}
+
+// Close releases the resources held by the handler: the session is closed if
+// it was dialed by the handler, but left open if it was provided by the caller.
+// All subsequent operations fail with ErrClosed.
+func (m Handler) Close() {
+	if m.state == nil {
+		return
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	if m.state.closed {
+		return
+	}
+	m.state.closed = true
+	if m.state.owned != nil {
+		m.state.owned.Close()
+	}
+}
+
+// closed tells if Close was called on the handler.
+func (m Handler) closed() bool {
+	if m.state == nil {
+		return false
+	}
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	return m.state.closed
+}
+
 // close returns a mgo.Collection's session to the connection pool.
 func (m Handler) close(c *mgo.Collection) {
 	c.Database.Session.Close()
+	m.log("debug", "session released", "collection", c.FullName)
+}
+
+// readFrom applies the read preference set with WithReadTags, if any, to the
+// session of c.
+func (m Handler) readFrom(c *mgo.Collection) {
+	if len(m.readTags) == 0 {
+		return
+	}
+	c.Database.Session.SelectServers(m.readTags...)
+	// Refresh so the tags apply to the socket reserved for the reads
+	c.Database.Session.SetMode(m.readMode, true)
 }
 
-// Insert inserts new items in the mongo collection.
+// log sends a diagnostic log to the logger set with WithLogger, if any.
+func (m Handler) log(level, msg string, kv ...interface{}) {
+	if m.logger != nil {
+		m.logger(level, msg, kv...)
+	}
+}
+
+// Insert inserts new items in the mongo collection. Nested maps and slices of
+// the payloads, including slices of maps, are stored as embedded documents and
+// arrays, and read back as map[string]interface{} and []interface{} values.
 func (m Handler) Insert(ctx context.Context, items []*resource.Item) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
 	mItems := make([]interface{}, len(items))
 	for i, item := range items {
-		mItems[i] = newMongoItem(item)
+		mItem, err := m.toMongoItem(item)
+		if err != nil {
+			return err
+		}
+		mItems[i] = mItem
 	}
 	c, err := m.c(ctx)
 	if err != nil {
 		return err
 	}
 	defer m.close(c)
+	if m.unorderedBulk {
+		err = m.insertUnordered(c, mItems)
+		if iErr, ok := err.(*InsertError); ok {
+			ids := make([]interface{}, 0, iErr.Inserted)
+			for i, item := range items {
+				if _, failed := iErr.Failures[i]; !failed {
+					ids = append(ids, item.ID)
+				}
+			}
+			m.mutated("insert", ids...)
+		} else if err == nil {
+			m.mutated("insert", itemIDs(items)...)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
 	err = c.Insert(mItems...)
 	if mgo.IsDup(err) {
 		// Duplicate ID key
 		err = resource.ErrConflict
+	} else {
+		err = m.mapError(err)
+	}
+	if err == nil {
+		m.mutated("insert", itemIDs(items)...)
 	}
 	if ctx.Err() != nil {
 		return ctx.Err()
@@ -131,48 +602,213 @@ func (m Handler) Insert(ctx context.Context, items []*resource.Item) error {
 	return err
 }
 
+// itemIDs returns the IDs of items.
+func itemIDs(items []*resource.Item) []interface{} {
+	ids := make([]interface{}, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+	return ids
+}
+
+// mutated calls the hook set with WithMutationHook, if any, after the items
+// with the given ids were written by the op operation.
+func (m Handler) mutated(op string, ids ...interface{}) {
+	if m.mutationHook != nil && len(ids) > 0 {
+		m.mutationHook(op, ids)
+	}
+}
+
+// insertUnordered inserts mItems in an unordered bulk, so a failing item
+// doesn't prevent the others to be inserted. Per item failures are reported
+// with an *InsertError.
+func (m Handler) insertUnordered(c *mgo.Collection, mItems []interface{}) error {
+	b := c.Bulk()
+	b.Unordered()
+	b.Insert(mItems...)
+	_, err := b.Run()
+	bErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return m.mapError(err)
+	}
+	iErr := &InsertError{Failures: map[int]error{}}
+	for _, ec := range bErr.Cases() {
+		if ec.Index < 0 {
+			// The failure is not tied to an item, the whole batch failed
+			return m.mapError(ec.Err)
+		}
+		if mgo.IsDup(ec.Err) {
+			iErr.Failures[ec.Index] = resource.ErrConflict
+		} else {
+			iErr.Failures[ec.Index] = m.mapError(ec.Err)
+		}
+	}
+	iErr.Inserted = len(mItems) - len(iErr.Failures)
+	return iErr
+}
+
 // Update replace an item by a new one in the mongo collection.
 func (m Handler) Update(ctx context.Context, item *resource.Item, original *resource.Item) error {
-	mItem := newMongoItem(item)
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if err := m.setVersion(item, original); err != nil {
+		return err
+	}
+	mItem, err := m.toMongoItem(item)
+	if err != nil {
+		return err
+	}
 	c, err := m.c(ctx)
 	if err != nil {
 		return err
 	}
 	defer m.close(c)
-	s := bson.M{"_id": original.ID}
-	if strings.HasPrefix(original.ETag, "p-") {
-		// If the original ETag is in "p-[id]" format,
-		// then _etag field must be absent from the resource in DB
-		s["_etag"] = bson.M{"$exists": false}
-	} else {
-		s["_etag"] = original.ETag
+	s, err := m.itemSelector(original, item)
+	if err != nil {
+		return err
 	}
-	err = c.Update(s, mItem)
-	if err == mgo.ErrNotFound {
-		// Determine if the item is not found or if the item is found but etag missmatch
-		var count int
-		count, err = c.FindId(original.ID).Count()
-		if err != nil {
-			// The find returned an unexpected err, just forward it with no mapping
-		} else if count == 0 {
-			err = resource.ErrNotFound
-		} else if ctx.Err() != nil {
-			err = ctx.Err()
-		} else {
-			// If the item were found, it means that its etag didn't match
-			err = resource.ErrConflict
+	write := func() (err error) {
+		switch {
+		case m.currentDate:
+			// Let the server stamp the update time and read it back
+			var res struct {
+				Updated time.Time `bson:"_updated"`
+			}
+			change := mgo.Change{Update: m.update(mItem, original), Upsert: m.upsert, ReturnNew: true}
+			if _, err = apply(ctx, c, s, bson.M{"_updated": 1}, change, &res); err == nil {
+				item.Updated = res.Updated
+			}
+		case m.upsert:
+			_, err = c.Upsert(s, m.update(mItem, original))
+		default:
+			err = c.Update(s, mItem)
 		}
+		return err
 	}
-	return err
+	err = write()
+	if m.upsert && mgo.IsDup(err) {
+		// A concurrent upsert may have inserted the item after the selector
+		// was evaluated: retry, now as an update of the inserted item.
+		m.log("debug", "retrying upsert after a duplicate key error", "id", original.ID)
+		err = write()
+	}
+	if m.upsert && mgo.IsDup(err) {
+		// The item exists but the selector didn't match it: its etag mismatches
+		err = resource.ErrConflict
+	} else if err == mgo.ErrNotFound {
+		err = m.notFoundError(ctx, c, original.ID)
+	} else if err == nil {
+		m.mutated("update", original.ID)
+	}
+	return m.mapError(err)
 }
 
-// Delete deletes an item from the mongo collection.
-func (m Handler) Delete(ctx context.Context, item *resource.Item) error {
+// UpdateReturnOld works like Update but also returns the item as it was
+// stored before the update, fetched in the same round trip. With WithUpsert,
+// a nil item is returned when the update inserted the item.
+func (m Handler) UpdateReturnOld(ctx context.Context, item *resource.Item, original *resource.Item) (*resource.Item, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if err := m.setVersion(item, original); err != nil {
+		return nil, err
+	}
+	mItem, err := m.toMongoItem(item)
+	if err != nil {
+		return nil, err
+	}
 	c, err := m.c(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer m.close(c)
+	s, err := m.itemSelector(original, item)
+	if err != nil {
+		return nil, err
+	}
+	change := mgo.Change{Update: m.update(mItem, original), Upsert: m.upsert, ReturnNew: false}
+	var old mongoItem
+	info, err := apply(ctx, c, s, nil, change, &old)
+	if m.upsert && mgo.IsDup(err) {
+		// Retry after a concurrent upsert inserted the item, as in Update
+		m.log("debug", "retrying upsert after a duplicate key error", "id", original.ID)
+		info, err = apply(ctx, c, s, nil, change, &old)
+	}
+	if err != nil {
+		if m.upsert && mgo.IsDup(err) {
+			err = resource.ErrConflict
+		} else if err == mgo.ErrNotFound {
+			err = m.notFoundError(ctx, c, original.ID)
+		}
+		return nil, m.mapError(err)
+	}
+	m.mutated("update", original.ID)
+	if info.UpsertedId != nil {
+		// The item didn't exist before the update
+		return nil, nil
+	}
+	return m.toItem(&old)
+}
+
+// itemSelector returns the selector of the stored version of item, including
+// the shard key fields set with WithShardKey so the write is routed to a single
+// shard. Shard key values missing from item are taken from next, the new
+// version of the item, if not nil.
+func (m Handler) itemSelector(item, next *resource.Item) (bson.M, error) {
+	s := selector(item)
+	id, err := m.encodeID(item.ID)
+	if err != nil {
+		return nil, err
+	}
+	s["_id"] = id
+	if m.versionField != "" {
+		// The version replaces the etag as the write precondition
+		delete(s, "_etag")
+		if v, found := item.Payload[m.versionField]; found && v != nil {
+			s[m.versionField] = v
+		} else {
+			s[m.versionField] = bson.M{"$exists": false}
+		}
+	}
+	if m.updatedPrecondition && !item.Updated.IsZero() {
+		// The item must not have been updated since it was read
+		s["_updated"] = bson.M{"$lte": item.Updated}
+	}
+	payloads := []map[string]interface{}{item.Payload}
+	if next != nil {
+		payloads = append(payloads, next.Payload)
+	}
+	if err := m.addShardKey(s, payloads...); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// addShardKey adds to the selector s the fields of the shard key set with
+// WithShardKey, taking their value from the first of payloads holding them.
+func (m Handler) addShardKey(s bson.M, payloads ...map[string]interface{}) error {
+	for _, f := range m.shardKey {
+		var v interface{}
+		found := false
+		for _, p := range payloads {
+			if v, found = p[f]; found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		v, err := m.translateValue(f, v)
+		if err != nil {
+			return err
+		}
+		s[f] = v
+	}
+	return nil
+}
+
+// selector returns the Mongo query selecting the stored version of item, so
+// that write operations only apply if the item has not been modified since.
+func selector(item *resource.Item) bson.M {
 	s := bson.M{"_id": item.ID}
 	if strings.HasPrefix(item.ETag, "p-") {
 		// If the item ETag is in "p-[id]" format,
@@ -181,23 +817,127 @@ func (m Handler) Delete(ctx context.Context, item *resource.Item) error {
 	} else {
 		s["_etag"] = item.ETag
 	}
+	return s
+}
+
+// setVersion sets the version field of item, configured with WithVersionField,
+// to the version of original plus one, or 1 if original has no version.
+func (m Handler) setVersion(item, original *resource.Item) error {
+	if m.versionField == "" {
+		return nil
+	}
+	next := 1
+	switch v := original.Payload[m.versionField].(type) {
+	case nil:
+	case int:
+		next = v + 1
+	case int32:
+		next = int(v) + 1
+	case int64:
+		next = int(v) + 1
+	case float64:
+		next = int(v) + 1
+	default:
+		return fmt.Errorf("%s: invalid version type: %T", m.versionField, v)
+	}
+	if item.Payload == nil {
+		item.Payload = map[string]interface{}{}
+	}
+	item.Payload[m.versionField] = next
+	return nil
+}
+
+// notFoundError determines if a write operation didn't match because the item
+// is not found or because the item is found but its etag mismatches.
+func (m Handler) notFoundError(ctx context.Context, c *mgo.Collection, id interface{}) error {
+	id, err := m.encodeID(id)
+	if err != nil {
+		return err
+	}
+	count, err := c.FindId(id).Count()
+	if err != nil {
+		// The find returned an unexpected err, just forward it with no mapping
+		return m.mapError(err)
+	} else if count == 0 {
+		return resource.ErrNotFound
+	} else if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// If the item were found, it means that its etag didn't match
+	return resource.ErrConflict
+}
+
+// update returns the update document replacing the stored item by mItem.
+// A plain replacement is used unless the server must set the update date or
+// the item may be created by the update.
+func (m Handler) update(mItem *mongoItem, original *resource.Item) interface{} {
+	var u bson.M
+	switch {
+	case m.currentDate:
+		u = currentDateUpdate(mItem, original)
+	case m.upsert:
+		u = setUpdate(mItem, original)
+		u["$set"].(bson.M)["_updated"] = mItem.Updated
+	default:
+		return mItem
+	}
+	if m.upsert && m.createdField != "" {
+		// Only set the creation date when the update inserts the item
+		delete(u["$set"].(bson.M), m.createdField)
+		u["$setOnInsert"] = bson.M{m.createdField: mItem.Updated}
+	}
+	return u
+}
+
+// currentDateUpdate builds an update document replacing the stored item by
+// mItem while having the server set the _updated field to its current date.
+func currentDateUpdate(mItem *mongoItem, original *resource.Item) bson.M {
+	u := setUpdate(mItem, original)
+	u["$currentDate"] = bson.M{"_updated": true}
+	return u
+}
+
+// setUpdate builds an update document setting the fields of mItem and
+// removing those of original which are not part of mItem anymore.
+func setUpdate(mItem *mongoItem, original *resource.Item) bson.M {
+	set := bson.M{"_etag": mItem.ETag}
+	for k, v := range mItem.Payload {
+		set[k] = v
+	}
+	u := bson.M{"$set": set}
+	// Remove the fields which are not part of the new item anymore
+	unset := bson.M{}
+	for k := range original.Payload {
+		if _, found := mItem.Payload[k]; !found && k != "id" && k != "_id" {
+			unset[k] = ""
+		}
+	}
+	if len(unset) > 0 {
+		u["$unset"] = unset
+	}
+	return u
+}
+
+// Delete deletes an item from the mongo collection.
+func (m Handler) Delete(ctx context.Context, item *resource.Item) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	s, err := m.itemSelector(item, nil)
+	if err != nil {
+		return err
+	}
 	err = c.Remove(s)
 	if err == mgo.ErrNotFound {
-		// Determine if the item is not found or if the item is found but etag missmatch
-		var count int
-		count, err = c.FindId(item.ID).Count()
-		if err != nil {
-			// The find returned an unexpected err, just forward it with no mapping
-		} else if count == 0 {
-			err = resource.ErrNotFound
-		} else if ctx.Err() != nil {
-			err = ctx.Err()
-		} else {
-			// If the item were found, it means that its etag didn't match
-			err = resource.ErrConflict
-		}
+		err = m.notFoundError(ctx, c, item.ID)
+	} else if err == nil {
+		m.mutated("delete", item.ID)
 	}
-	return err
+	return m.mapError(err)
 }
 
 // Clear clears all items from the mongo collection matching the query. Note
@@ -206,13 +946,22 @@ func (m Handler) Delete(ctx context.Context, item *resource.Item) error {
 // the maximum document size in MongDB (usually 16MiB):
 // https://docs.mongodb.com/manual/reference/limits/#bson-documents
 func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
-	// When not applying windowing, qry will be passed directly to RemoveAll.
-	qry, err := getQuery(q)
-	if err != nil {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if err := m.checkWindow(q.Window); err != nil {
 		return 0, err
 	}
 
-	c, err := m.c(ctx)
+	// When not applying windowing, qry will be passed directly to RemoveAll.
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.checkClearFilter(ctx, qry); err != nil {
+		return 0, err
+	}
+
+	c, err := m.c(ctx)
 	if err != nil {
 		return 0, err
 	}
@@ -226,13 +975,13 @@ func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
 		// This solution does not handle the case where a query containg all
 		// IDs is larger than the maximum BSON document size in MongoDB:
 		// https://docs.mongodb.com/manual/reference/limits/#bson-documents
-		srt := getSort(q)
+		srt := m.getSort(q)
 		mq := applyWindow(c.Find(qry).Sort(srt...), *q.Window)
 
 		if ids, err := selectIDs(c, mq); err == nil {
 			qry = bson.M{"_id": bson.M{"$in": ids}}
 		} else {
-			return 0, err
+			return 0, m.mapError(err)
 		}
 	}
 
@@ -241,6 +990,8 @@ func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
 	info, err := c.RemoveAll(qry)
 	if err == nil {
 		err = ctx.Err()
+	} else {
+		err = m.mapError(err)
 	}
 	if info == nil {
 		return 0, err
@@ -248,8 +999,180 @@ func (m Handler) Clear(ctx context.Context, q *query.Query) (int, error) {
 	return info.Removed, err
 }
 
+// clearBatchSize is the number of items ClearProgress deletes at once.
+const clearBatchSize = 1000
+
+// ClearProgress works like Clear but deletes the matching items by batches of
+// 1000, calling fn with the number of items deleted so far after each batch,
+// to report the progress of large purges. ctx is checked between batches; on
+// error, the number of items deleted before the failure is returned along with
+// the error. fn may be nil. As purging is a long running operation, the WithDefaultTimeout
+// option does not apply.
+func (m Handler) ClearProgress(ctx context.Context, q *query.Query, fn func(deleted int)) (int, error) {
+	if err := m.checkWindow(q.Window); err != nil {
+		return 0, err
+	}
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.checkClearFilter(ctx, qry); err != nil {
+		return 0, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close(c)
+
+	// next returns the ids of the next batch of items to delete
+	var next func() ([]interface{}, error)
+	if q.Window != nil {
+		ids, err := selectIDs(c, applyWindow(c.Find(qry).Sort(m.getSort(q)...), *q.Window))
+		if err != nil {
+			return 0, m.mapError(err)
+		}
+		next = func() ([]interface{}, error) {
+			n := clearBatchSize
+			if n > len(ids) {
+				n = len(ids)
+			}
+			batch := ids[:n]
+			ids = ids[n:]
+			return batch, nil
+		}
+	} else {
+		next = func() ([]interface{}, error) {
+			return selectIDs(c, c.Find(qry).Limit(clearBatchSize))
+		}
+	}
+
+	deleted := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		ids, err := next()
+		if err != nil {
+			return deleted, m.mapError(err)
+		}
+		if len(ids) == 0 {
+			return deleted, nil
+		}
+		info, err := c.RemoveAll(clearBatchSelector(qry, ids))
+		if info != nil {
+			deleted += info.Removed
+		}
+		if err != nil {
+			return deleted, m.mapError(err)
+		}
+		if fn != nil {
+			fn(deleted)
+		}
+	}
+}
+
+// clearBatchSelector returns the selector of a ClearProgress batch deleting
+// the items with the given ids, provided they still match qry so the items
+// modified since they were selected are left alone.
+func clearBatchSelector(qry bson.M, ids []interface{}) bson.M {
+	s := bson.M{"_id": bson.M{"$in": ids}}
+	f := bson.M{}
+	for k, v := range qry {
+		if k == "$comment" {
+			// Only allowed at the top level
+			s[k] = v
+		} else {
+			f[k] = v
+		}
+	}
+	if len(f) > 0 {
+		s["$and"] = []bson.M{f}
+	}
+	return s
+}
+
+// ClearDryRun reports the number of items Clear would remove for the same
+// query without deleting anything. When withIDs is true, the IDs of those
+// items are returned as well, in the order they would be selected.
+func (m Handler) ClearDryRun(ctx context.Context, q *query.Query, withIDs bool) (int, []interface{}, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if err := m.checkWindow(q.Window); err != nil {
+		return 0, nil, err
+	}
+
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer m.close(c)
+
+	mq := c.Find(qry)
+	if q.Window != nil {
+		mq = applyWindow(mq.Sort(m.getSort(q)...), *q.Window)
+	}
+
+	if !withIDs {
+		n, err := mq.Count()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return n, nil, m.mapError(err)
+	}
+
+	ids, err := selectIDs(c, mq)
+	if err == nil {
+		err = ctx.Err()
+	}
+	err = m.mapError(err)
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(ids), ids, nil
+}
+
 // Find items from the mongo collection matching the provided query.
+//
+// When a window is requested, the total is deduced from the returned page when
+// possible, -1 being returned otherwise. With WithExactTotal, it is counted by
+// a second query run concurrently with the find: as writes may happen between
+// the two queries, the total may then disagree with the returned page. With
+// WithConsistentTotal, both are computed by a single aggregation instead.
+//
+// For aggregate queries, each group is returned as an item whose ID is the
+// grouped value (nil for the items missing the field) and whose payload holds
+// the id and the number of items in the group as total. The etag of those
+// items is a hash of their content, so it changes with the total.
+//
+// With WithCursorRetry, a query whose cursor was killed by the server is run
+// again from the start.
 func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	for retries := 0; ; retries++ {
+		list, err := m.findPage(ctx, q)
+		if m.cursorRetry && isCursorNotFound(err) && retries < cursorRetries {
+			m.log("warn", "cursor not found, restarting find", "error", err)
+			continue
+		}
+		return list, err
+	}
+}
+
+// findPage runs the query q of Find.
+func (m Handler) findPage(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if err := m.checkWindow(q.Window); err != nil {
+		return nil, err
+	}
+
 	// MongoDB will return all records on Limit=0. Workaround that behavior.
 	// https://docs.mongodb.com/manual/reference/method/cursor.limit/#zero-value
 	if q.Window != nil && q.Window.Limit == 0 {
@@ -265,34 +1188,91 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 		return list, err
 	}
 
-	qry, err := getQuery(q)
+	qry, err := m.getQuery(q)
 	if err != nil {
 		return nil, err
 	}
 
-	agg, err := getAggregateQuery(q)
+	agg, err := m.getAggregateQuery(q)
 	if err != nil {
 		return nil, err
 	}
 
-	srt := getSort(q)
+	srt := m.getSort(q)
 
 	c, err := m.c(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer m.close(c)
+	m.readFrom(c)
 
+	start := time.Now()
+	m.log("debug", "find", "query", qry, "sort", srt)
+	if m.facetable(q) {
+		// Apply context deadline if any
+		var dur time.Duration
+		if dl, ok := ctx.Deadline(); ok {
+			dur = dl.Sub(time.Now())
+		}
+		return m.findFacet(c, qry, srt, q, dur)
+	}
 	limit := -1
 
+	type countResult struct {
+		n   int
+		err error
+	}
+	var total chan countResult
+	if m.exactTotal && q.Window != nil && len(q.Aggregate) == 0 {
+		// Count the matching items concurrently with the find
+		total = make(chan countResult, 1)
+		go func() {
+			n, err := m.count(ctx, qry)
+			total <- countResult{n, err}
+		}()
+	}
+
 	var iter *mgo.Iter
+	// scanCapped is set when the query is subject to WithMaxScan
+	scanCapped := false
 
 	//Check if its aggregation query or just normal filter query
-	if len(q.Aggregate) == 0 {
-		mq := c.Find(qry).Sort(srt...)
+	if len(q.Aggregate) == 0 && len(m.computed) > 0 {
+		// Computed fields require to go thru the aggregation framework
+		pipeline := []bson.M{bson.M{"$match": qry}}
+
+		if q.Window != nil {
+			pipeline = applyPipelineWindow(pipeline, srt, *q.Window)
+			limit = q.Window.Limit
+		} else {
+			pipeline = append(pipeline, bson.M{"$sort": getSortStage(srt)})
+		}
+		pipeline = append(pipeline, bson.M{"$addFields": m.computed})
+		if len(m.slices) > 0 {
+			pipeline = append(pipeline, bson.M{"$addFields": m.getSliceExpressions()})
+		}
+
+		// Perform request
+		iter = m.pipe(c, pipeline).Iter()
+	} else if len(q.Aggregate) == 0 && m.collation != nil {
+		if q.Window != nil {
+			limit = q.Window.Limit
+		}
+
+		// Apply context deadline if any
+		var dur time.Duration
+		if dl, ok := ctx.Deadline(); ok {
+			dur = dl.Sub(time.Now())
+		}
+
+		// Perform request
+		iter = m.findCollation(c, qry, srt, q, dur)
+	} else if len(q.Aggregate) == 0 {
+		mq := m.find(c, qry, srt, q)
+		scanCapped = m.maxScan > 0
 
 		if q.Window != nil {
-			mq = applyWindow(mq, *q.Window)
 			limit = q.Window.Limit
 		}
 
@@ -308,9 +1288,14 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 		// Perform request
 		iter = mq.Iter()
 	} else {
-		mq := c.Pipe([]bson.M{
-			bson.M{"$match": qry}, bson.M{"$group": agg},
-		})
+		pipeline := m.groupPipeline(qry, agg)
+
+		if q.Window != nil {
+			pipeline = applyPipelineWindow(pipeline, []string{"_id"}, *q.Window)
+			limit = q.Window.Limit
+		}
+
+		mq := m.pipe(c, pipeline)
 
 		// Perform request
 		iter = mq.Iter()
@@ -332,10 +1317,40 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 			iter.Close()
 			return nil, err
 		}
-		list.Items = append(list.Items, newItem(&mItem))
+		var etag string
+		if len(q.Aggregate) > 0 {
+			if etag, err = contentETag(mItem); err != nil {
+				iter.Close()
+				return nil, err
+			}
+		}
+		item, err := m.toItem(&mItem)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if etag != "" {
+			item.ETag = etag
+		}
+		list.Items = append(list.Items, item)
 	}
 	if err := iter.Close(); err != nil {
-		return nil, err
+		m.log("error", "find failed", "query", qry, "error", err)
+		if len(q.Aggregate) > 0 || len(m.computed) > 0 {
+			return nil, m.mapPipeError(err)
+		}
+		return nil, m.mapError(err)
+	}
+	m.log("debug", "find done", "items", len(list.Items), "duration", time.Since(start))
+	if scanCapped && (limit < 0 || len(list.Items) < limit) {
+		// The page is not filled: check if the scan stopped early
+		hit, err := m.scanLimitHit(c, qry, srt, q)
+		if err != nil {
+			return nil, err
+		}
+		if hit {
+			return nil, ErrScanLimitExceeded
+		}
 	}
 	// If the number of returned elements is lower than requested limit, or no
 	// limit is requested, we can deduce the total number of element for free.
@@ -350,20 +1365,423 @@ func (m Handler) Find(ctx context.Context, q *query.Query) (*resource.ItemList,
 			list.Total = len(list.Items)
 		}
 	}
+	if total != nil {
+		res := <-total
+		if res.err != nil {
+			return nil, res.err
+		}
+		list.Total = res.n
+	}
 	return list, err
 }
 
+// facetable tells if the query q can be run by findFacet, for
+// WithConsistentTotal. Aggregations support neither the positional projection
+// of WithMatchedElement nor WithMaxScan.
+func (m Handler) facetable(q *query.Query) bool {
+	if !m.consistentTotal || q.Window == nil || len(q.Aggregate) > 0 || len(m.computed) > 0 || m.collation != nil || m.maxScan > 0 {
+		return false
+	}
+	if m.matchedElement {
+		for _, exp := range q.Predicate {
+			if _, ok := exp.(*query.ElemMatch); ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// facetPipeline returns the aggregation pipeline returning, in a single
+// document, the page of the items matching qry within the window of q, sorted
+// by srt and projected according to q, along with the total number of matching
+// items.
+func (m Handler) facetPipeline(qry bson.M, srt []string, q *query.Query) []bson.M {
+	page := applyPipelineWindow(nil, srt, *q.Window)
+	if p := m.getFieldProjection(q); p != nil {
+		for f := range m.slices {
+			p[getField(f)] = 1
+		}
+		page = append(page, bson.M{"$project": p})
+	}
+	if len(m.slices) > 0 {
+		page = append(page, bson.M{"$addFields": m.getSliceExpressions()})
+	}
+	return []bson.M{
+		{"$match": qry},
+		{"$facet": bson.M{
+			"items": page,
+			"total": []bson.M{{"$count": "n"}},
+		}},
+	}
+}
+
+// facetCommand builds the aggregate command running the facetPipeline of the
+// query q, as mgo.Pipe can't set a time limit.
+func (m Handler) facetCommand(c *mgo.Collection, qry bson.M, srt []string, q *query.Query, maxTime time.Duration) bson.D {
+	cmd := bson.D{
+		{Name: "aggregate", Value: c.Name},
+		{Name: "pipeline", Value: m.facetPipeline(qry, srt, q)},
+		{Name: "cursor", Value: bson.M{}},
+	}
+	if m.allowDiskUse {
+		cmd = append(cmd, bson.DocElem{Name: "allowDiskUse", Value: true})
+	}
+	if maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: int64(maxTime / time.Millisecond)})
+	}
+	return cmd
+}
+
+// findFacet finds the page of items matching qry along with their total using
+// a single $facet aggregation, for WithConsistentTotal.
+func (m Handler) findFacet(c *mgo.Collection, qry bson.M, srt []string, q *query.Query, maxTime time.Duration) (*resource.ItemList, error) {
+	var r cursorReply
+	if err := c.Database.Run(m.facetCommand(c, qry, srt, q, maxTime), &r); err != nil {
+		return nil, m.mapPipeError(err)
+	}
+	var res struct {
+		Items []mongoItem `bson:"items"`
+		Total []struct {
+			N int `bson:"n"`
+		} `bson:"total"`
+	}
+	if len(r.Cursor.FirstBatch) > 0 {
+		if err := r.Cursor.FirstBatch[0].Unmarshal(&res); err != nil {
+			return nil, err
+		}
+	}
+	list := &resource.ItemList{
+		Total: 0,
+		Limit: q.Window.Limit,
+		Items: make([]*resource.Item, 0, len(res.Items)),
+	}
+	if len(res.Total) > 0 {
+		// $count outputs no document when no item matches
+		list.Total = res.Total[0].N
+	}
+	for i := range res.Items {
+		item, err := m.toItem(&res.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		list.Items = append(list.Items, item)
+	}
+	return list, nil
+}
+
+// MustFind works like Find but fails with resource.ErrNotFound when no item
+// matches the query, so callers requiring a match don't have to check the
+// length of the returned list. An empty page whose total is unknown, as when
+// the window offset is beyond the last item, is checked by counting the
+// matching items, setting the total of the returned list.
+func (m Handler) MustFind(ctx context.Context, q *query.Query) (*resource.ItemList, error) {
+	list, err := m.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.Items) > 0 {
+		return list, nil
+	}
+	if list.Total < 0 {
+		if list.Total, err = m.Count(ctx, q); err != nil {
+			return nil, err
+		}
+	}
+	if list.Total == 0 {
+		// With a zero limit, no item is returned but the total is counted
+		return nil, resource.ErrNotFound
+	}
+	return list, nil
+}
+
+// find prepares the query of the items matching qry, the translation of q,
+// sorted by srt and within the window of q if any.
+func (m Handler) find(c *mgo.Collection, qry bson.M, srt []string, q *query.Query) *mgo.Query {
+	mq := c.Find(qry).Sort(srt...)
+	if proj := m.getProjection(q); proj != nil {
+		mq = mq.Select(proj)
+	}
+	if q.Window != nil {
+		mq = applyWindow(mq, *q.Window)
+	}
+	if m.prefetch != nil {
+		mq.Prefetch(*m.prefetch)
+	}
+	if m.maxScan > 0 {
+		mq.SetMaxScan(m.maxScan)
+	}
+	return mq
+}
+
+// scanLimitHit tells if the query of the items matching qry examined as many
+// documents as allowed with WithMaxScan, using the query plan.
+func (m Handler) scanLimitHit(c *mgo.Collection, qry bson.M, srt []string, q *query.Query) (bool, error) {
+	var plan bson.M
+	if err := m.find(c, qry, srt, q).Explain(&plan); err != nil {
+		return false, m.mapError(err)
+	}
+	return examined(plan) >= m.maxScan, nil
+}
+
+// examined returns the number of documents or index keys examined according
+// to an explain output, in the executionStats format of MongoDB 3.0+ or the
+// legacy format.
+func examined(plan bson.M) int {
+	n := 0
+	max := func(v interface{}) {
+		var i int
+		switch v := v.(type) {
+		case int:
+			i = v
+		case int64:
+			i = int(v)
+		case float64:
+			i = int(v)
+		}
+		if i > n {
+			n = i
+		}
+	}
+	if stats, ok := plan["executionStats"].(bson.M); ok {
+		max(stats["totalDocsExamined"])
+		max(stats["totalKeysExamined"])
+	}
+	max(plan["nscanned"])
+	max(plan["nscannedObjects"])
+	return n
+}
+
+// FindEach calls fn with each item matching q, in the query sort order and
+// within the query window, without loading the whole result set in memory.
+// The iteration stops at the first error returned by fn, which is then
+// returned. Aggregate queries are not supported.
+func (m Handler) FindEach(ctx context.Context, q *query.Query, fn func(item *resource.Item) error) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if len(q.Aggregate) > 0 {
+		return resource.ErrNotImplemented
+	}
+	if err := m.checkWindow(q.Window); err != nil {
+		return err
+	}
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	m.readFrom(c)
+	if m.noCursorTimeout {
+		c.Database.Session.SetCursorTimeout(0)
+	}
+	srt := m.getSort(q)
+	open := func(skip int) iterator {
+		rq, ok := skipWindow(q, skip)
+		if !ok {
+			return nil
+		}
+		return m.find(c, qry, srt, rq).Iter()
+	}
+	return m.each(ctx, open, fn)
+}
+
+// cursorRetries is the number of times Find and FindEach run a query again
+// after its cursor was killed by the server, with WithCursorRetry.
+const cursorRetries = 3
+
+// iterator iterates over the documents returned by a query, like *mgo.Iter.
+type iterator interface {
+	Next(result interface{}) bool
+	Close() error
+}
+
+// each calls fn with the items read from the iterator returned by open(0).
+// With WithCursorRetry, when the cursor is killed by the server, the iteration
+// resumes with the iterator returned by open(n), n being the number of items
+// already read, open returning nil if no item is left.
+func (m Handler) each(ctx context.Context, open func(skip int) iterator, fn func(item *resource.Item) error) error {
+	iter := open(0)
+	read, retries := 0, 0
+	var mItem mongoItem
+	for {
+		for iter.Next(&mItem) {
+			if err := ctx.Err(); err != nil {
+				iter.Close()
+				return err
+			}
+			read++
+			item, err := m.toItem(&mItem)
+			if err == nil {
+				err = fn(item)
+			}
+			if err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		err := iter.Close()
+		if !m.cursorRetry || !isCursorNotFound(err) || retries == cursorRetries {
+			return m.mapError(err)
+		}
+		retries++
+		m.log("warn", "cursor not found, resuming iteration", "skip", read, "error", err)
+		if iter = open(read); iter == nil {
+			return nil
+		}
+	}
+}
+
+// skipWindow returns a copy of q whose window skips the first skip items of
+// the one of q. It returns false if the window of q has no item left.
+func skipWindow(q *query.Query, skip int) (*query.Query, bool) {
+	if skip == 0 {
+		return q, true
+	}
+	w := query.Window{Offset: skip, Limit: -1}
+	if q.Window != nil {
+		w.Offset += q.Window.Offset
+		if q.Window.Limit > -1 {
+			if w.Limit = q.Window.Limit - skip; w.Limit <= 0 {
+				return nil, false
+			}
+		}
+	}
+	rq := *q
+	rq.Window = &w
+	return &rq, true
+}
+
+// RawOption customizes the query run by FindRawDocs.
+type RawOption func(*rawOptions)
+
+// rawOptions holds the settings of a FindRawDocs query.
+type rawOptions struct {
+	hint    []string
+	comment string
+}
+
+// RawHint makes FindRawDocs use the index on the given key fields, each field
+// being prefixed by "-" if the index is descending on it, like "-updated".
+// The query fails if no such index exists.
+func RawHint(key ...string) RawOption {
+	return func(o *rawOptions) {
+		o.hint = key
+	}
+}
+
+// RawComment attaches comment to the query run by FindRawDocs, to identify it
+// in the database profiler and logs.
+func RawComment(comment string) RawOption {
+	return func(o *rawOptions) {
+		o.comment = comment
+	}
+}
+
+// FindRawDocs returns the stored documents matching q verbatim, including the
+// _id, _etag and _updated fields, without converting them into items. The
+// query sort and window are applied but aggregate queries are not supported.
+// Options may set an index hint and a comment to the query.
+func (m Handler) FindRawDocs(ctx context.Context, q *query.Query, opts ...RawOption) ([]bson.M, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	if len(q.Aggregate) > 0 {
+		return nil, resource.ErrNotImplemented
+	}
+	if err := m.checkWindow(q.Window); err != nil {
+		return nil, err
+	}
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	var o rawOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	hint, err := rawHint(o.hint)
+	if err != nil {
+		return nil, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	mq := c.Find(qry).Sort(m.getSort(q)...)
+	if q.Window != nil {
+		mq = applyWindow(mq, *q.Window)
+	}
+	if len(hint) > 0 {
+		mq = mq.Hint(hint...)
+	}
+	if o.comment != "" {
+		mq = mq.Comment(o.comment)
+	}
+	// Apply context deadline if any
+	if dl, ok := ctx.Deadline(); ok {
+		dur := dl.Sub(time.Now())
+		if dur < 0 {
+			dur = 0
+		}
+		mq.SetMaxTime(dur)
+	}
+	docs := []bson.M{}
+	if err := mq.All(&docs); err != nil {
+		return nil, m.mapError(err)
+	}
+	return docs, nil
+}
+
+// rawHint checks the fields of an index hint and maps them to Mongo fields.
+func rawHint(key []string) ([]string, error) {
+	hint := make([]string, 0, len(key))
+	for _, k := range key {
+		f, dir := k, ""
+		if strings.HasPrefix(f, "-") {
+			f, dir = f[1:], "-"
+		}
+		if f == "" || strings.ContainsAny(f[:1], "$@+") {
+			return nil, fmt.Errorf("invalid hint key %q", k)
+		}
+		hint = append(hint, dir+getField(f))
+	}
+	return hint, nil
+}
+
 // Count counts the number items matching the lookup filter
 func (m Handler) Count(ctx context.Context, query *query.Query) (int, error) {
-	q, err := getQuery(query)
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	q, err := m.getQuery(query)
 	if err != nil {
 		return -1, err
 	}
+	return m.count(ctx, q)
+}
+
+// count counts the number of items matching the mongo query q.
+func (m Handler) count(ctx context.Context, q bson.M) (int, error) {
 	c, err := m.c(ctx)
 	if err != nil {
 		return -1, err
 	}
 	defer m.close(c)
+	m.readFrom(c)
+	if m.collation != nil {
+		var dur time.Duration
+		if dl, ok := ctx.Deadline(); ok {
+			dur = dl.Sub(time.Now())
+		}
+		n, err := m.countCollation(c, q, dur)
+		if isNamespaceNotFound(err) {
+			return 0, nil
+		}
+		return n, m.mapError(err)
+	}
 	mq := c.Find(q)
 	// Apply context deadline if any
 	if dl, ok := ctx.Deadline(); ok {
@@ -373,5 +1791,211 @@ func (m Handler) Count(ctx context.Context, query *query.Query) (int, error) {
 		}
 		mq.SetMaxTime(dur)
 	}
-	return mq.Count()
+	n, err := mq.Count()
+	if isNamespaceNotFound(err) {
+		// A collection which doesn't exist yet is empty
+		return 0, nil
+	}
+	return n, m.mapError(err)
+}
+
+// MultiGet returns the items with the given ids, in the order of ids. The
+// slot of an id matching no item holds nil, so the returned slice always has
+// the length of ids. With WithObjectID, hex string ids are converted to
+// bson.ObjectId.
+func (m Handler) MultiGet(ctx context.Context, ids []interface{}) ([]*resource.Item, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	mIDs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		mID, err := m.translateValue("_id", id)
+		if err != nil {
+			return nil, err
+		}
+		mIDs[i] = mID
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	mq := c.Find(bson.M{"_id": bson.M{"$in": mIDs}})
+	if proj := m.getProjection(&query.Query{}); proj != nil {
+		mq = mq.Select(proj)
+	}
+	// Items are matched on their stored ids, which may not be hashable
+	byID := make(map[string]*resource.Item, len(ids))
+	iter := mq.Iter()
+	var mItem mongoItem
+	for iter.Next(&mItem) {
+		k, err := idKey(mItem.ID)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		item, err := m.toItem(&mItem)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		byID[k] = item
+		mItem = mongoItem{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, m.mapError(err)
+	}
+	items := make([]*resource.Item, len(ids))
+	for i, id := range mIDs {
+		k, err := idKey(id)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = byID[k]
+	}
+	return items, nil
+}
+
+// idKey returns a map key identifying the stored id, as ids like []byte or
+// bson.M can't be used as map keys themselves.
+func idKey(id interface{}) (string, error) {
+	b, err := bson.Marshal(bson.D{{Name: "_id", Value: id}})
+	return string(b), err
+}
+
+// Exists tells if an item with the given id is stored, only fetching its id.
+// With WithObjectID, a hex string id is converted to a bson.ObjectId.
+func (m Handler) Exists(ctx context.Context, id interface{}) (bool, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	id, err := m.translateValue("_id", id)
+	if err != nil {
+		return false, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer m.close(c)
+	mq := c.FindId(id).Select(bson.M{"_id": 1})
+	// Apply context deadline if any
+	if dl, ok := ctx.Deadline(); ok {
+		dur := dl.Sub(time.Now())
+		if dur < 0 {
+			dur = 0
+		}
+		mq.SetMaxTime(dur)
+	}
+	var res bson.M
+	if err = mq.One(&res); err == mgo.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, m.mapError(err)
+	}
+	return true, nil
+}
+
+// GroupCount counts the items matching the query predicate for each distinct
+// value of field. Values are formatted with fmt.Sprint to build the map keys,
+// items missing the field being counted under the empty string.
+func (m Handler) GroupCount(ctx context.Context, q *query.Query, field string) (map[string]int, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	grp, err := m.getAggregateQuery(&query.Query{Aggregate: query.Aggregate{&query.Group{Field: field}}})
+	if err != nil {
+		return nil, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	var res struct {
+		Value interface{} `bson:"_id"`
+		Total int         `bson:"total"`
+	}
+	counts := map[string]int{}
+	iter := m.pipe(c, m.groupPipeline(qry, grp)).Iter()
+	for iter.Next(&res) {
+		k := ""
+		if res.Value != nil {
+			k = fmt.Sprint(res.Value)
+		}
+		counts[k] += res.Total
+	}
+	if err := iter.Close(); err != nil {
+		return nil, m.mapPipeError(err)
+	}
+	return counts, nil
+}
+
+// DistinctCount returns the number of distinct values of field among the
+// items matching the query predicate, items missing the field being ignored.
+// The values are counted by the server without being transferred.
+func (m Handler) DistinctCount(ctx context.Context, q *query.Query, field string) (int, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	f, err := m.getGroupField(field)
+	if err != nil {
+		return 0, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer m.close(c)
+	pipeline := m.groupPipeline(bson.M{"$and": []bson.M{qry, {f: bson.M{"$exists": true}}}}, bson.M{"_id": "$" + f})
+	pipeline = append(pipeline, bson.M{"$count": "n"})
+	var res struct {
+		N int `bson:"n"`
+	}
+	if err := m.pipe(c, pipeline).One(&res); err != nil && err != mgo.ErrNotFound {
+		return 0, m.mapPipeError(err)
+	}
+	return res.N, nil
+}
+
+// Autocomplete returns up to limit distinct values of field starting with
+// prefix, in ascending order. The prefix is matched by a case sensitive regex
+// anchored at the start of the values, which MongoDB can resolve using a
+// standard index on field. Regex metacharacters in prefix are escaped.
+func (m Handler) Autocomplete(ctx context.Context, field, prefix string, limit int) ([]interface{}, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	f, err := m.getGroupField(field)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := []bson.M{
+		{"$match": bson.M{f: bson.RegEx{Pattern: "^" + regexp.QuoteMeta(prefix)}}},
+		{"$group": bson.M{"_id": "$" + f}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer m.close(c)
+	var res struct {
+		Value interface{} `bson:"_id"`
+	}
+	values := []interface{}{}
+	iter := m.pipe(c, pipeline).Iter()
+	for iter.Next(&res) {
+		values = append(values, res.Value)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, m.mapPipeError(err)
+	}
+	return values, nil
 }
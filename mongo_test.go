@@ -2,6 +2,11 @@ package mongo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,6 +15,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // Mongo doesn't support nanoseconds
@@ -67,6 +73,76 @@ func TestInsert(t *testing.T) {
 	assert.Equal(t, resource.ErrConflict, err)
 }
 
+func TestNewMongoItemIDCollision(t *testing.T) {
+	item := &resource.Item{
+		ID:   "1234",
+		ETag: "etag",
+		Payload: map[string]interface{}{
+			"id":  "1234",
+			"_id": "legacy",
+			"foo": "bar",
+		},
+	}
+	mItem := newMongoItem(item)
+	assert.Equal(t, "1234", mItem.ID)
+	assert.Equal(t, map[string]interface{}{"foo": "bar"}, mItem.Payload)
+
+	mItem.Payload["_id"] = "legacy"
+	assert.Equal(t, map[string]interface{}{"id": "1234", "foo": "bar"}, newItem(mItem).Payload)
+}
+
+func TestInsertDupWithErrorMapper(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testinsertdupwitherrormapper")()
+	errMapped := errors.New("mapped")
+	h := NewHandler(s, "testinsertdupwitherrormapper", "test", WithErrorMapper(func(err error) error {
+		return errMapped
+	}))
+	items := []*resource.Item{{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1"}}}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+	// The duplicate key error is detected before the mapper is applied
+	assert.Equal(t, resource.ErrConflict, h.Insert(ctx, items))
+}
+
+func TestInsertIDCollision(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testinsertidcollision")()
+	h := NewHandler(s, "testinsertidcollision", "test")
+	items := []*resource.Item{
+		{
+			ID:      "1234",
+			ETag:    "etag",
+			Updated: now,
+			Payload: map[string]interface{}{
+				"id":  "1234",
+				"_id": "legacy",
+				"foo": "bar",
+			},
+		},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.Find(ctx, &query.Query{})
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "1234", l.Items[0].ID)
+		assert.Equal(t, map[string]interface{}{"id": "1234", "foo": "bar"}, l.Items[0].Payload)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
@@ -320,6 +396,144 @@ func TestClearOffset(t *testing.T) {
 	assertCollectionIDs(t, s.DB(dbName).C(cName), []string{"1", "2", "4"})
 }
 
+func TestRequirePredicateOnClear(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithRequirePredicateOnClear())
+	ctx := context.Background()
+	_, err := h.Clear(ctx, &query.Query{})
+	assert.Equal(t, ErrUnfilteredClear, err)
+	_, err = h.Clear(ctx, &query.Query{Window: &query.Window{Limit: 10}})
+	assert.Equal(t, ErrUnfilteredClear, err)
+	_, err = h.Clear(ctx, &query.Query{Predicate: query.Predicate{Comment("purge")}})
+	assert.Equal(t, ErrUnfilteredClear, err)
+	_, err = h.ClearProgress(ctx, &query.Query{}, nil)
+	assert.Equal(t, ErrUnfilteredClear, err)
+
+	assert.NoError(t, h.checkClearFilter(ctx, bson.M{"foo": "bar"}))
+	assert.NoError(t, h.checkClearFilter(AllowUnfilteredClear(ctx), bson.M{}))
+	assert.NoError(t, NewHandler(&mgo.Session{}, "db", "test").checkClearFilter(ctx, bson.M{}))
+}
+
+func TestClearUnfiltered(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testclearunfiltered")()
+	h := NewHandler(s, "testclearunfiltered", "test", WithRequirePredicateOnClear())
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "c"}},
+	}))
+
+	_, err = h.Clear(ctx, &query.Query{})
+	assert.Equal(t, ErrUnfilteredClear, err)
+	n, err := h.Clear(ctx, &query.Query{Predicate: query.MustParsePredicate(`{name:"a"}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = h.Clear(AllowUnfilteredClear(ctx), &query.Query{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestClearDryRun(t *testing.T) {
+	const (
+		dbName = "testcleardryrun"
+		cName  = "test"
+	)
+
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, dbName)()
+	h := NewHandler(s, dbName, cName)
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "name": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "name": "b"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "name": "d"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "name": "c"}},
+	}
+
+	err = h.Insert(context.Background(), items)
+	require.NoError(t, err)
+
+	q, err := query.New("", `{name:{$in:["c","d"]}}`, "", nil)
+	if assert.NoError(t, err) {
+		n, ids, err := h.ClearDryRun(context.Background(), q, false)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Nil(t, ids)
+	}
+
+	q, err = query.New("", `{name:{$in:["c","d"]}}`, "name", &query.Window{Limit: 1})
+	if assert.NoError(t, err) {
+		n, ids, err := h.ClearDryRun(context.Background(), q, true)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, []interface{}{"4"}, ids)
+	}
+
+	// Nothing must have been removed
+	assertCollectionIDs(t, s.DB(dbName).C(cName), []string{"1", "2", "3", "4"})
+}
+
+func TestNewHandlers(t *testing.T) {
+	s := &mgo.Session{}
+	hs := NewHandlers(s, "db", []string{"foo", "bar"})
+	if assert.Len(t, hs, 2) {
+		for _, name := range []string{"foo", "bar"} {
+			c, err := hs[name].collection(context.Background())
+			if assert.NoError(t, err) {
+				assert.Equal(t, name, c.Name)
+				// All handlers must reuse the provided session
+				assert.True(t, s == c.Database.Session)
+			}
+		}
+	}
+}
+
+func TestNewHandlersConcurrent(t *testing.T) {
+	const dbName = "testnewhandlers"
+
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, dbName)()
+	collections := []string{"a", "b", "c", "d"}
+	hs := NewHandlers(s, dbName, collections)
+
+	var wg sync.WaitGroup
+	for _, name := range collections {
+		wg.Add(1)
+		go func(h Handler) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				id := fmt.Sprint(i)
+				err := h.Insert(context.Background(), []*resource.Item{
+					{ID: id, Payload: map[string]interface{}{"id": id}},
+				})
+				assert.NoError(t, err)
+			}
+			n, err := h.Count(context.Background(), &query.Query{})
+			assert.NoError(t, err)
+			assert.Equal(t, 10, n)
+		}(hs[name])
+	}
+	wg.Wait()
+}
+
 func TestFind(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping test in short mode.")
@@ -447,3 +661,2369 @@ func TestFind(t *testing.T) {
 		}
 	}
 }
+
+func TestFindMaxOffset(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "testfindmaxoffset", "test", WithMaxOffset(2))
+	ctx := context.Background()
+
+	// Over-cap offsets are rejected before reaching the database
+	_, err := h.Find(ctx, &query.Query{Window: &query.Window{Limit: 1, Offset: 3}})
+	assert.Equal(t, ErrMaxOffsetExceeded, err)
+	_, err = h.Clear(ctx, &query.Query{Window: &query.Window{Limit: 1, Offset: 3}})
+	assert.Equal(t, ErrMaxOffsetExceeded, err)
+
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindmaxoffset")()
+	h = NewHandler(s, "testfindmaxoffset", "test", WithMaxOffset(2))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3"}},
+	}
+	require.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.Find(ctx, &query.Query{Window: &query.Window{Limit: 10, Offset: 2}})
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 1)
+	}
+	_, err = h.Find(ctx, &query.Query{Window: &query.Window{Limit: 10, Offset: 3}})
+	assert.Equal(t, ErrMaxOffsetExceeded, err)
+}
+
+func TestFindAggregateWindow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindaggregatewindow")()
+	h := NewHandler(s, "testfindaggregatewindow", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "category": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "category": "a"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "category": "b"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "category": "c"}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "category": "d"}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	agg := query.MustParseAggregate(`{category:{$group:true}}`)
+	var groups []interface{}
+	for offset := 0; offset < 6; offset += 2 {
+		l, err := h.Find(ctx, &query.Query{Aggregate: agg, Window: &query.Window{Limit: 2, Offset: offset}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, item := range l.Items {
+			groups = append(groups, item.ID)
+		}
+		if offset == 4 {
+			assert.Len(t, l.Items, 1)
+			assert.Equal(t, 5, l.Total)
+		}
+	}
+	assert.Equal(t, []interface{}{"a", "b", "c", "d"}, groups[:4])
+}
+
+func TestFindAggregateItems(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindaggregateitems")()
+	h := NewHandler(s, "testfindaggregateitems", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "category": "a"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "category": "a"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "category": "b"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4"}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.Find(ctx, &query.Query{Aggregate: query.MustParseAggregate(`{category:{$group:true}}`)})
+	require.NoError(t, err)
+	assert.Equal(t, 3, l.Total)
+	got := map[interface{}]*resource.Item{}
+	for _, item := range l.Items {
+		got[item.ID] = item
+	}
+	if assert.Contains(t, got, "a") {
+		assert.Equal(t, map[string]interface{}{"id": "a", "total": 2}, got["a"].Payload)
+	}
+	if assert.Contains(t, got, "b") {
+		assert.Equal(t, map[string]interface{}{"id": "b", "total": 1}, got["b"].Payload)
+	}
+	if assert.Contains(t, got, nil) {
+		assert.Equal(t, 1, got[nil].Payload["total"])
+	}
+
+	// Etags hash the group content: stable across queries, changing with it
+	l2, err := h.Find(ctx, &query.Query{Aggregate: query.MustParseAggregate(`{category:{$group:true}}`)})
+	require.NoError(t, err)
+	for _, item := range l2.Items {
+		assert.Equal(t, got[item.ID].ETag, item.ETag)
+	}
+	assert.NotEqual(t, got["a"].ETag, got["b"].ETag)
+	require.NoError(t, h.Insert(ctx, []*resource.Item{{ID: "5", Payload: map[string]interface{}{"id": "5", "category": "b"}}}))
+	l2, err = h.Find(ctx, &query.Query{Aggregate: query.MustParseAggregate(`{category:{$group:true}}`)})
+	require.NoError(t, err)
+	for _, item := range l2.Items {
+		if item.ID == "b" {
+			assert.NotEqual(t, got["b"].ETag, item.ETag)
+		}
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	row := func(id interface{}, total int) mongoItem {
+		return mongoItem{ID: id, Payload: map[string]interface{}{"total": total, "min": 1, "max": 9, "avg": 4.5}}
+	}
+	a, err := contentETag(row("a", 2))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		// Payload fields are hashed in a stable order
+		again, err := contentETag(row("a", 2))
+		require.NoError(t, err)
+		assert.Equal(t, a, again)
+	}
+	b, err := contentETag(row("b", 2))
+	require.NoError(t, err)
+	assert.NotEqual(t, a, b)
+	c, err := contentETag(row("a", 3))
+	require.NoError(t, err)
+	assert.NotEqual(t, a, c)
+}
+
+func TestFindEmbeddedExactMatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindembeddedexactmatch")()
+	h := NewHandler(s, "testfindembeddedexactmatch", "test")
+	c := s.DB("testfindembeddedexactmatch").C("test")
+	require.NoError(t, c.Insert(
+		bson.M{"_id": "1", "address": bson.D{{Name: "city", Value: "NYC"}}},
+		bson.M{"_id": "2", "address": bson.D{{Name: "city", Value: "NYC"}, {Name: "zip", Value: "10001"}}},
+		bson.M{"_id": "3", "address": bson.D{{Name: "zip", Value: "10001"}, {Name: "city", Value: "NYC"}}},
+	))
+	ctx := context.Background()
+
+	find := func(p string) []interface{} {
+		l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(p), Sort: query.Sort{{Name: "id"}}})
+		require.NoError(t, err)
+		ids := []interface{}{}
+		for _, item := range l.Items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+	// Extra fields prevent the match
+	assert.Equal(t, []interface{}{"1"}, find(`{address:{city:"NYC"}}`))
+	// Dotted fields match regardless of the other fields and their order
+	assert.Equal(t, []interface{}{"2", "3"}, find(`{address.zip:"10001"}`))
+}
+
+func TestJournaled(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, &mgo.Safe{}, safe(ctx))
+	assert.Equal(t, &mgo.Safe{J: true}, safe(Journaled(ctx)))
+	assert.Nil(t, writeConcern(ctx))
+	assert.Equal(t, bson.M{"j": true}, writeConcern(Journaled(ctx)))
+}
+
+func TestJournaledInsert(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testjournaledinsert")()
+	h := NewHandler(s, "testjournaledinsert", "test")
+	ctx := context.Background()
+
+	c, err := h.c(Journaled(ctx))
+	require.NoError(t, err)
+	assert.True(t, c.Database.Session.Safe().J)
+	h.close(c)
+	c, err = h.c(ctx)
+	require.NoError(t, err)
+	assert.False(t, c.Database.Session.Safe().J)
+	h.close(c)
+
+	items := []*resource.Item{{ID: "1", Payload: map[string]interface{}{"id": "1"}}}
+	assert.NoError(t, h.Insert(Journaled(ctx), items))
+}
+
+func TestJournaledCommands(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testjournaledcommands")()
+	ctx := Journaled(context.Background())
+	items := []*resource.Item{{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}}
+	require.NoError(t, NewHandler(s, "testjournaledcommands", "test").Insert(ctx, items))
+
+	// Updates run as findAndModify commands carrying the write concern
+	h := NewHandler(s, "testjournaledcommands", "test", WithCurrentDate())
+	item := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	require.NoError(t, h.Update(ctx, item, items[0]))
+	assert.False(t, item.Updated.IsZero())
+	old, err := h.UpdateReturnOld(ctx, &resource.Item{ID: "1", ETag: "c", Payload: map[string]interface{}{"id": "1"}}, item)
+	if assert.NoError(t, err) && assert.NotNil(t, old) {
+		assert.Equal(t, "baz", old.Payload["foo"])
+	}
+	_, err = h.UpdateReturnOld(ctx, &resource.Item{ID: "1", ETag: "d", Payload: map[string]interface{}{"id": "1"}}, item)
+	assert.Equal(t, resource.ErrConflict, err)
+	ok, err := h.ConditionalUpdate(ctx, "1", map[string]interface{}{}, map[string]interface{}{"foo": "qux"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	inserted, updated, err := h.UpsertMany(ctx, []*resource.Item{
+		{ID: "1", ETag: "e", Payload: map[string]interface{}{"id": "1"}},
+		{ID: "2", ETag: "e", Payload: map[string]interface{}{"id": "2"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inserted)
+	assert.Equal(t, 1, updated)
+}
+
+func TestFindMatchedElement(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindmatchedelement")()
+	h := NewHandler(s, "testfindmatchedelement", "test", WithMatchedElement())
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "title": "foo", "body": "...", "comments": []interface{}{
+			map[string]interface{}{"author": "alice", "text": "first"},
+			map[string]interface{}{"author": "bob", "text": "second"},
+			map[string]interface{}{"author": "carol", "text": "third"},
+		}}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.Find(ctx, &query.Query{
+		Predicate:  query.MustParsePredicate(`{comments:{$elemMatch:{author:"bob"}}}`),
+		Projection: query.Projection{{Name: "title"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, "a", l.Items[0].ETag)
+	assert.Equal(t, map[string]interface{}{
+		"id":    "1",
+		"title": "foo",
+		"comments": []interface{}{
+			map[string]interface{}{"author": "bob", "text": "second"},
+		},
+	}, l.Items[0].Payload)
+
+	// Without $elemMatch, items are returned whole
+	l, err = h.Find(ctx, &query.Query{})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Len(t, l.Items[0].Payload["comments"], 3)
+}
+
+func TestFindLogger(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindlogger")()
+	var mu sync.Mutex
+	var logs []string
+	logger := func(level, msg string, kv ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, level+" "+msg)
+		assert.Equal(t, 0, len(kv)%2, "odd number of key/values for %q", msg)
+	}
+	h := NewHandler(s, "testfindlogger", "test", WithLogger(logger))
+	_, err = h.Find(context.Background(), &query.Query{Predicate: query.MustParsePredicate(`{foo:"bar"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"debug session acquired", "debug find", "debug find done", "debug session released"}, logs)
+}
+
+func TestExamined(t *testing.T) {
+	assert.Equal(t, 0, examined(bson.M{}))
+	assert.Equal(t, 12, examined(bson.M{"executionStats": bson.M{"totalDocsExamined": 10, "totalKeysExamined": int64(12)}}))
+	assert.Equal(t, 7, examined(bson.M{"nscanned": 7, "nscannedObjects": float64(5)}))
+}
+
+func TestFindMaxScan(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindmaxscan")()
+	h := NewHandler(s, "testfindmaxscan", "test", WithMaxScan(10))
+	items := make([]*resource.Item, 100)
+	for i := range items {
+		id := fmt.Sprint(i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}}
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	// The unindexed field n requires a full scan
+	_, err = h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{n:99}`)})
+	assert.Equal(t, ErrScanLimitExceeded, err)
+
+	// Pages filled before reaching the limit are returned
+	l, err := h.Find(ctx, &query.Query{Window: &query.Window{Limit: 5}})
+	require.NoError(t, err)
+	assert.Len(t, l.Items, 5)
+}
+
+func TestMultiGet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testmultiget")()
+	h := NewHandler(s, "testmultiget", "test")
+	items := make([]*resource.Item, 10)
+	for i := range items {
+		id := fmt.Sprint(i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "n": i}}
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	got, err := h.MultiGet(ctx, []interface{}{"7", "2", "missing", "9", "2"})
+	require.NoError(t, err)
+	require.Len(t, got, 5)
+	for i, id := range []interface{}{"7", "2", nil, "9", "2"} {
+		if id == nil {
+			assert.Nil(t, got[i])
+			continue
+		}
+		if assert.NotNil(t, got[i]) {
+			assert.Equal(t, id, got[i].ID)
+		}
+	}
+
+	got, err = h.MultiGet(ctx, []interface{}{})
+	assert.NoError(t, err)
+	assert.Len(t, got, 0)
+}
+
+func TestIDKey(t *testing.T) {
+	for _, pair := range [][2]interface{}{
+		{"1", "1"},
+		{[]byte{1, 2}, []byte{1, 2}},
+		{bson.M{"a": 1}, bson.M{"a": 1}},
+		{bson.Binary{Kind: 0x04, Data: []byte{1}}, bson.Binary{Kind: 0x04, Data: []byte{1}}},
+	} {
+		a, err := idKey(pair[0])
+		require.NoError(t, err)
+		b, err := idKey(pair[1])
+		require.NoError(t, err)
+		assert.Equal(t, a, b)
+	}
+	a, _ := idKey([]byte{1, 2})
+	b, _ := idKey([]byte{1, 3})
+	assert.NotEqual(t, a, b)
+}
+
+func TestMultiGetBinaryIDs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testmultigetbinaryids")()
+	h := NewHandler(s, "testmultigetbinaryids", "test")
+	ctx := context.Background()
+	ids := []interface{}{[]byte{1}, []byte{2}}
+	for _, id := range ids {
+		require.NoError(t, h.Insert(ctx, []*resource.Item{{ID: id, ETag: "a", Payload: map[string]interface{}{"id": id}}}))
+	}
+	got, err := h.MultiGet(ctx, []interface{}{[]byte{2}, []byte{3}, []byte{1}})
+	require.NoError(t, err)
+	if assert.Len(t, got, 3) && assert.NotNil(t, got[0]) && assert.NotNil(t, got[2]) {
+		assert.Equal(t, []byte{2}, got[0].ID)
+		assert.Nil(t, got[1])
+		assert.Equal(t, []byte{1}, got[2].ID)
+	}
+
+	// Stored ids produced by a codec
+	h = NewHandler(s, "testmultigetbinaryids", "uuids", uuidCodec)
+	require.NoError(t, h.Insert(ctx, []*resource.Item{{ID: uuid1, ETag: "a", Payload: map[string]interface{}{"id": uuid1}}}))
+	got, err = h.MultiGet(ctx, []interface{}{uuid2, uuid1})
+	require.NoError(t, err)
+	if assert.Len(t, got, 2) && assert.NotNil(t, got[1]) {
+		assert.Nil(t, got[0])
+		assert.Equal(t, uuid1, got[1].ID)
+	}
+}
+
+func TestMultiGetInvalidObjectID(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithObjectID())
+	_, err := h.MultiGet(context.Background(), []interface{}{"foo"})
+	assert.EqualError(t, err, `invalid object id: "foo"`)
+}
+
+func TestWithReadTags(t *testing.T) {
+	tags := []bson.D{{{Name: "dc", Value: "east"}}, {}}
+	h := NewHandler(&mgo.Session{}, "db", "test", WithReadTags(mgo.Nearest, tags...))
+	assert.NoError(t, h.err)
+	assert.Equal(t, mgo.Nearest, h.readMode)
+	assert.Equal(t, tags, h.readTags)
+
+	for _, mode := range []mgo.Mode{mgo.Secondary, mgo.SecondaryPreferred, mgo.PrimaryPreferred} {
+		h = NewHandler(&mgo.Session{}, "db", "test", WithReadTags(mode, tags...))
+		assert.NoError(t, h.err, mode)
+	}
+	for _, mode := range []mgo.Mode{mgo.Primary, mgo.Eventual, mgo.Monotonic, mgo.Strong} {
+		h = NewHandler(&mgo.Session{}, "db", "test", WithReadTags(mode, tags...))
+		assert.EqualError(t, h.err, "invalid read mode: tags only apply to the Nearest, Secondary, SecondaryPreferred and PrimaryPreferred modes", mode)
+	}
+}
+
+func TestFindReadTags(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindreadtags")()
+	items := []*resource.Item{{ID: "1", Payload: map[string]interface{}{"id": "1"}}}
+	ctx := context.Background()
+
+	// No member has the tags: reads time out, writes are not affected
+	h := NewHandler(s, "testfindreadtags", "test", WithReadTags(mgo.Nearest, bson.D{{Name: "dc", Value: "nowhere"}}))
+	require.NoError(t, h.Insert(ctx, items))
+	c, err := h.c(ctx)
+	require.NoError(t, err)
+	h.readFrom(c)
+	assert.Equal(t, mgo.Nearest, c.Database.Session.Mode())
+	h.close(c)
+	tctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, err = h.Find(tctx, &query.Query{})
+	assert.Error(t, err)
+	_, err = h.Count(tctx, &query.Query{})
+	assert.Error(t, err)
+
+	// The empty tag set matches any member
+	h = NewHandler(s, "testfindreadtags", "test", WithReadTags(mgo.Nearest, bson.D{{Name: "dc", Value: "nowhere"}}, bson.D{}))
+	l, err := h.Find(ctx, &query.Query{})
+	require.NoError(t, err)
+	assert.Len(t, l.Items, 1)
+}
+
+func TestClearProgress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testclearprogress")()
+	h := NewHandler(s, "testclearprogress", "test")
+	items := make([]*resource.Item, 2600)
+	for i := range items {
+		id := fmt.Sprint(i)
+		items[i] = &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "even": i%2 == 0}}
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	var progress []int
+	n, err := h.ClearProgress(ctx, &query.Query{Predicate: query.MustParsePredicate(`{even:true}`)}, func(deleted int) {
+		progress = append(progress, deleted)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1300, n)
+	assert.Equal(t, []int{1000, 1300}, progress)
+
+	progress = nil
+	n, err = h.ClearProgress(ctx, &query.Query{Window: &query.Window{Limit: 1200}}, func(deleted int) {
+		progress = append(progress, deleted)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1200, n)
+	assert.Equal(t, []int{1000, 1200}, progress)
+
+	count, err := h.Count(ctx, &query.Query{})
+	require.NoError(t, err)
+	assert.Equal(t, 100, count)
+
+	// A nil fn is ignored
+	n, err = h.ClearProgress(ctx, &query.Query{Window: &query.Window{Limit: 10}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = h.ClearProgress(canceled, &query.Query{}, func(int) {})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestClearBatchSelector(t *testing.T) {
+	ids := []interface{}{"1", "2"}
+	assert.Equal(t, bson.M{"_id": bson.M{"$in": ids}}, clearBatchSelector(bson.M{}, ids))
+	assert.Equal(t, bson.M{
+		"_id":  bson.M{"$in": ids},
+		"$and": []bson.M{{"even": true}},
+	}, clearBatchSelector(bson.M{"even": true}, ids))
+	assert.Equal(t, bson.M{
+		"_id":      bson.M{"$in": ids},
+		"$and":     []bson.M{{"_id": bson.M{"$gt": "0"}}},
+		"$comment": "purge",
+	}, clearBatchSelector(bson.M{"_id": bson.M{"$gt": "0"}, "$comment": "purge"}, ids))
+}
+
+func TestVersionSelector(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithVersionField("version"))
+	s, err := h.itemSelector(&resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"version": 3}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "version": 3}, s)
+	s, err = h.itemSelector(&resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "version": bson.M{"$exists": false}}, s)
+
+	item := &resource.Item{ID: "1", Payload: map[string]interface{}{"version": 10}}
+	assert.NoError(t, h.setVersion(item, &resource.Item{ID: "1", Payload: map[string]interface{}{"version": float64(3)}}))
+	assert.Equal(t, 4, item.Payload["version"])
+	assert.NoError(t, h.setVersion(item, &resource.Item{ID: "1"}))
+	assert.Equal(t, 1, item.Payload["version"])
+	assert.EqualError(t, h.setVersion(item, &resource.Item{ID: "1", Payload: map[string]interface{}{"version": "3"}}), "version: invalid version type: string")
+}
+
+func TestUpdatedPreconditionSelector(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithUpdatedPrecondition())
+	s, err := h.itemSelector(&resource.Item{ID: "1", ETag: "a", Updated: now}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "_etag": "a", "_updated": bson.M{"$lte": now}}, s)
+	s, err = h.itemSelector(&resource.Item{ID: "1", ETag: "a"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "_etag": "a"}, s)
+}
+
+func TestUpdatedPrecondition(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testupdatedprecondition")()
+	h := NewHandler(s, "testupdatedprecondition", "test", WithUpdatedPrecondition())
+	ctx := context.Background()
+	updated := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	original := &resource.Item{ID: "1", ETag: "a", Updated: updated, Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	require.NoError(t, h.Insert(ctx, []*resource.Item{original}))
+	// Another writer updated the item keeping its etag
+	c := s.DB("testupdatedprecondition").C("test")
+	require.NoError(t, c.UpdateId("1", bson.M{"$set": bson.M{"_updated": updated.Add(time.Minute)}}))
+
+	next := &resource.Item{ID: "1", ETag: "b", Updated: updated.Add(2 * time.Minute), Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	assert.Equal(t, resource.ErrConflict, h.Update(ctx, next, original))
+	assert.Equal(t, resource.ErrConflict, h.Delete(ctx, original))
+
+	// Without the option, the etag alone is checked
+	assert.NoError(t, NewHandler(s, "testupdatedprecondition", "test").Update(ctx, next, original))
+}
+
+func TestUpdateVersionField(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testupdateversionfield")()
+	h := NewHandler(s, "testupdateversionfield", "test", WithVersionField("version"))
+	ctx := context.Background()
+	v1 := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "foo": "bar", "version": 1}}
+	require.NoError(t, h.Insert(ctx, []*resource.Item{v1}))
+
+	v2 := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "foo": "baz"}}
+	require.NoError(t, h.Update(ctx, v2, v1))
+	assert.Equal(t, 2, v2.Payload["version"])
+	l, err := h.Find(ctx, &query.Query{})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, 2, l.Items[0].Payload["version"])
+	assert.Equal(t, "baz", l.Items[0].Payload["foo"])
+
+	// The etag matches but the version is stale
+	stale := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "version": 1}}
+	v3 := &resource.Item{ID: "1", ETag: "c", Payload: map[string]interface{}{"id": "1"}}
+	assert.Equal(t, resource.ErrConflict, h.Update(ctx, v3, stale))
+	assert.Equal(t, resource.ErrConflict, h.Delete(ctx, stale))
+
+	// The etag mismatches but the version is current
+	current := &resource.Item{ID: "1", ETag: "x", Payload: map[string]interface{}{"id": "1", "version": 2}}
+	assert.NoError(t, h.Update(ctx, v3, current))
+	assert.Equal(t, 3, v3.Payload["version"])
+	assert.NoError(t, h.Delete(ctx, v3))
+	assert.Equal(t, resource.ErrNotFound, h.Delete(ctx, v3))
+}
+
+func TestCurrentDateUpdate(t *testing.T) {
+	mItem := &mongoItem{ID: "1", ETag: "etag2", Payload: map[string]interface{}{"foo": "baz"}}
+	original := &resource.Item{ID: "1", ETag: "etag1", Payload: map[string]interface{}{"id": "1", "foo": "bar", "old": true}}
+	assert.Equal(t, bson.M{
+		"$set":         bson.M{"_etag": "etag2", "foo": "baz"},
+		"$unset":       bson.M{"old": ""},
+		"$currentDate": bson.M{"_updated": true},
+	}, currentDateUpdate(mItem, original))
+}
+
+func TestUpdateCurrentDate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testupdatecurrentdate")()
+	h := NewHandler(s, "testupdatecurrentdate", "test", WithCurrentDate())
+	clientTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldItem := &resource.Item{
+		ID:      "1234",
+		ETag:    "etag1",
+		Updated: clientTime,
+		Payload: map[string]interface{}{"id": "1234", "foo": "bar", "old": true},
+	}
+	newItem := &resource.Item{
+		ID:      "1234",
+		ETag:    "etag2",
+		Updated: clientTime,
+		Payload: map[string]interface{}{"id": "1234", "foo": "baz"},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{oldItem}))
+	require.NoError(t, h.Update(ctx, newItem, oldItem))
+
+	d := map[string]interface{}{}
+	require.NoError(t, s.DB("testupdatecurrentdate").C("test").FindId("1234").One(&d))
+	updated, _ := d["_updated"].(time.Time)
+	// The stored date comes from the server, not from the item
+	assert.True(t, updated.After(clientTime))
+	assert.True(t, newItem.Updated.Equal(updated))
+	assert.Equal(t, map[string]interface{}{"_id": "1234", "_etag": "etag2", "_updated": updated, "foo": "baz"}, d)
+
+	// Etag mismatch is still detected
+	assert.Equal(t, resource.ErrConflict, h.Update(ctx, newItem, oldItem))
+}
+
+func TestUpsertUpdateDoc(t *testing.T) {
+	updated := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	mItem := &mongoItem{ID: "1", ETag: "etag2", Updated: updated, Payload: map[string]interface{}{"foo": "baz", "_created": "forged"}}
+	original := &resource.Item{ID: "1", ETag: "etag1", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	h := NewHandler(&mgo.Session{}, "db", "test", WithUpsert(), WithCreatedField("_created"))
+	assert.Equal(t, bson.M{
+		"$set":         bson.M{"_etag": "etag2", "_updated": updated, "foo": "baz"},
+		"$setOnInsert": bson.M{"_created": updated},
+	}, h.update(mItem, original))
+
+	// Without upsert, the stored item is replaced
+	h = NewHandler(&mgo.Session{}, "db", "test", WithCreatedField("_created"))
+	assert.Equal(t, mItem, h.update(mItem, original))
+}
+
+func TestUpdateUpsertRace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testupdateupsertrace")()
+	h := NewHandler(s, "testupdateupsertrace", "test", WithUpsert())
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprint(i)
+		var wg sync.WaitGroup
+		errs := make([]error, 10)
+		for j := range errs {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				item := &resource.Item{ID: id, ETag: fmt.Sprint("etag", j), Payload: map[string]interface{}{"id": id, "j": j}}
+				errs[j] = h.Update(ctx, item, &resource.Item{ID: id, ETag: "p-" + id})
+			}(j)
+		}
+		wg.Wait()
+		// A single upsert inserts the item, the others being conflicts as
+		// the item they expected not to exist has been inserted
+		succeeded := 0
+		for _, err := range errs {
+			if err == nil {
+				succeeded++
+			} else {
+				assert.Equal(t, resource.ErrConflict, err)
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	}
+
+	// Upserts expecting the item inserted concurrently succeed
+	id := "same"
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for j := range errs {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			item := &resource.Item{ID: id, ETag: "etag", Payload: map[string]interface{}{"id": id}}
+			errs[j] = h.Update(ctx, item, &resource.Item{ID: id, ETag: "etag"})
+		}(j)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+}
+
+func TestUpdateUpsertCreatedField(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testupdateupsertcreatedfield")()
+	h := NewHandler(s, "testupdateupsertcreatedfield", "test", WithUpsert(), WithCreatedField("_created"))
+	created := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	item := &resource.Item{
+		ID:      "1234",
+		ETag:    "etag1",
+		Updated: created,
+		Payload: map[string]interface{}{"id": "1234", "foo": "bar"},
+	}
+	ctx := context.Background()
+	// The item doesn't exist yet, so the update inserts it
+	require.NoError(t, h.Update(ctx, item, &resource.Item{ID: "1234", ETag: "p-1234"}))
+
+	d := map[string]interface{}{}
+	c := s.DB("testupdateupsertcreatedfield").C("test")
+	require.NoError(t, c.FindId("1234").One(&d))
+	storedCreated, _ := d["_created"].(time.Time)
+	assert.True(t, storedCreated.Equal(created))
+	assert.Equal(t, "etag1", d["_etag"])
+
+	newItem := &resource.Item{
+		ID:      "1234",
+		ETag:    "etag2",
+		Updated: created.Add(time.Hour),
+		Payload: map[string]interface{}{"id": "1234", "foo": "baz"},
+	}
+	require.NoError(t, h.Update(ctx, newItem, item))
+	d = map[string]interface{}{}
+	require.NoError(t, c.FindId("1234").One(&d))
+	// The creation date is left untouched by the second update
+	assert.Equal(t, storedCreated, d["_created"])
+	assert.Equal(t, "etag2", d["_etag"])
+	assert.Equal(t, "baz", d["foo"])
+
+	// Etag mismatch on an existing item is still detected
+	assert.Equal(t, resource.ErrConflict, h.Update(ctx, newItem, item))
+}
+
+func TestFindReferenceField(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindreferencefield")()
+	parent1, parent2 := bson.NewObjectId(), bson.NewObjectId()
+	h := NewHandler(s, "testfindreferencefield", "test", WithObjectIDFields([]string{"parent"}))
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "parent": parent1}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "parent": parent2}},
+		{ID: "3", ETag: "c", Payload: map[string]interface{}{"id": "3", "parent": parent1}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{parent:"`+parent1.Hex()+`"}`, "id", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 2) {
+		assert.Equal(t, "1", l.Items[0].ID)
+		assert.Equal(t, "3", l.Items[1].ID)
+		// The reference is returned as stored
+		assert.Equal(t, map[string]interface{}{"id": "1", "parent": parent1}, l.Items[0].Payload)
+	}
+}
+
+func TestGroupCount(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testgroupcount")()
+	h := NewHandler(s, "testgroupcount", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "category": "a", "active": true}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "category": "a", "active": true}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "category": "b", "active": true}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "category": "b", "active": false}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "active": true}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	counts, err := h.GroupCount(ctx, &query.Query{}, "category")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]int{"a": 2, "b": 2, "": 1}, counts)
+	}
+
+	q, err := query.New("", `{active:true}`, "", nil)
+	require.NoError(t, err)
+	counts, err = h.GroupCount(ctx, q, "category")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]int{"a": 2, "b": 1, "": 1}, counts)
+	}
+}
+
+func TestFindAllowDiskUse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindallowdiskuse")()
+	// Store more than the 100MB an aggregation stage may use in memory
+	c := s.DB("testfindallowdiskuse").C("test")
+	blob := strings.Repeat("x", 1<<20)
+	for i := 0; i < 120; i++ {
+		require.NoError(t, c.Insert(bson.M{"_id": i, "rank": 120 - i, "blob": blob}))
+	}
+	computed := map[string]bson.M{"size": {"$strLenCP": "$blob"}}
+	ctx := context.Background()
+	q, err := query.New("", "", "rank", nil)
+	require.NoError(t, err)
+
+	h := NewHandler(s, "testfindallowdiskuse", "test", WithComputedFields(computed))
+	_, err = h.Find(ctx, q)
+	assert.Equal(t, ErrMemoryLimitExceeded, err)
+
+	h = NewHandler(s, "testfindallowdiskuse", "test", WithComputedFields(computed), WithAllowDiskUse())
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 120) {
+		assert.Equal(t, 119, l.Items[0].ID)
+	}
+}
+
+func TestInsertUnorderedBulk(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testinsertunorderedbulk")()
+	c := s.DB("testinsertunorderedbulk").C("test")
+	require.NoError(t, c.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true}))
+	h := NewHandler(s, "testinsertunorderedbulk", "test", WithUnorderedBulk())
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "email": "a@example.com"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "email": "a@example.com"}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "email": "c@example.com"}},
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "email": "d@example.com"}},
+	}
+	err = h.Insert(context.Background(), items)
+	if iErr, ok := err.(*InsertError); assert.True(t, ok, "expected *InsertError, got %v", err) {
+		assert.Equal(t, 2, iErr.Inserted)
+		assert.Len(t, iErr.Failures, 2)
+		assert.Equal(t, resource.ErrConflict, iErr.Failures[1])
+		assert.Equal(t, resource.ErrConflict, iErr.Failures[3])
+	}
+	n, err := c.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = c.FindId("3").Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestFindNotEqualArray(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindnotequalarray")()
+	h := NewHandler(s, "testfindnotequalarray", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tags": []interface{}{"go", "mongo"}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tags": []interface{}{"mongo"}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "tags": []interface{}{}}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4"}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{tags:{$ne:"go"}}`, "id", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		ids := []interface{}{}
+		for _, item := range l.Items {
+			ids = append(ids, item.ID)
+		}
+		// Item 1 has an element different from "go" but still contains it
+		assert.Equal(t, []interface{}{"2", "3", "4"}, ids)
+	}
+}
+
+func TestFindEmptyCollection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindemptycollection")()
+	ctx := context.Background()
+	predicates := []string{``, `{id:{$in:["1","2"]}}`, `{name:{$nin:["a"]}}`, `{age:{$gt:1}}`}
+	for _, opts := range [][]Option{nil, {WithExactTotal()}, {WithConsistentTotal()}} {
+		h := NewHandler(s, "testfindemptycollection", "test", opts...)
+		for _, p := range predicates {
+			q, err := query.New("", p, "", nil)
+			require.NoError(t, err)
+			for _, w := range []*query.Window{nil, {Limit: 10}, {Limit: -1}} {
+				q.Window = w
+				l, err := h.Find(ctx, q)
+				if assert.NoError(t, err, p) {
+					assert.Equal(t, 0, l.Total, "%s %v", p, w)
+					assert.Empty(t, l.Items, p)
+				}
+			}
+			n, err := h.Count(ctx, q)
+			assert.NoError(t, err, p)
+			assert.Equal(t, 0, n, p)
+		}
+	}
+
+	// Beyond the first page, only the exact total knows the collection is empty
+	q := &query.Query{Window: &query.Window{Offset: 10, Limit: 10}}
+	l, err := NewHandler(s, "testfindemptycollection", "test").Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, -1, l.Total)
+	}
+	l, err = NewHandler(s, "testfindemptycollection", "test", WithExactTotal()).Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, l.Total)
+	}
+}
+
+func TestFindExactTotal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindexacttotal")()
+	h := NewHandler(s, "testfindexacttotal", "test", WithExactTotal())
+	items := []*resource.Item{}
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprint(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "even": i%2 == 0}})
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.Find(ctx, &query.Query{Window: &query.Window{Limit: 2}})
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 2)
+		assert.Equal(t, 5, l.Total)
+	}
+
+	q, err := query.New("", `{even:false}`, "id", &query.Window{Limit: 2, Offset: 2})
+	require.NoError(t, err)
+	l, err = h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 1)
+		assert.Equal(t, 3, l.Total)
+	}
+
+	// The offset is out of range: the total can't be deduced from the page
+	l, err = h.Find(ctx, &query.Query{Window: &query.Window{Limit: 2, Offset: 10}})
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 0)
+		assert.Equal(t, 5, l.Total)
+	}
+}
+
+func TestFacetPipeline(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal(), WithSlice("tags", 2))
+	assert.Equal(t, []bson.M{
+		{"$match": bson.M{"even": true}},
+		{"$facet": bson.M{
+			"items": []bson.M{
+				{"$sort": bson.D{{Name: "_id", Value: 1}}},
+				{"$skip": 10},
+				{"$limit": 5},
+				{"$addFields": bson.M{"tags": bson.M{"$slice": []interface{}{"$tags", 2}}}},
+			},
+			"total": []bson.M{{"$count": "n"}},
+		}},
+	}, h.facetPipeline(bson.M{"even": true}, []string{"_id"}, &query.Query{Window: &query.Window{Offset: 10, Limit: 5}}))
+}
+
+func TestFacetPipelineProjection(t *testing.T) {
+	q := &query.Query{
+		Projection: query.Projection{{Name: "name"}, {Name: "address", Children: query.Projection{{Name: "city"}}}},
+		Window:     &query.Window{Limit: 5},
+	}
+	h := NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal(), WithSlice("tags", 2))
+	assert.Equal(t, []bson.M{
+		{"$sort": bson.D{{Name: "_id", Value: 1}}},
+		{"$limit": 5},
+		{"$addFields": bson.M{"tags": bson.M{"$slice": []interface{}{"$tags", 2}}}},
+	}, h.facetPipeline(bson.M{}, []string{"_id"}, q)[1]["$facet"].(bson.M)["items"])
+
+	h = NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal(), WithSlice("tags", 2), WithFieldProjection())
+	assert.Equal(t, []bson.M{
+		{"$sort": bson.D{{Name: "_id", Value: 1}}},
+		{"$limit": 5},
+		{"$project": bson.M{"name": 1, "address.city": 1, "tags": 1, "_etag": 1, "_updated": 1}},
+		{"$addFields": bson.M{"tags": bson.M{"$slice": []interface{}{"$tags", 2}}}},
+	}, h.facetPipeline(bson.M{}, []string{"_id"}, q)[1]["$facet"].(bson.M)["items"])
+
+	h = NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal(), WithCoveredProjection())
+	assert.Equal(t, []bson.M{
+		{"$sort": bson.D{{Name: "_id", Value: 1}}},
+		{"$limit": 5},
+		{"$project": bson.M{"_id": 0, "name": 1, "address.city": 1}},
+	}, h.facetPipeline(bson.M{}, []string{"_id"}, q)[1]["$facet"].(bson.M)["items"])
+}
+
+func TestFacetCommandMaxTime(t *testing.T) {
+	c := &mgo.Collection{Name: "test"}
+	q := &query.Query{Window: &query.Window{Limit: 5}}
+	h := NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal())
+	cmd := h.facetCommand(c, bson.M{}, []string{"_id"}, q, 0)
+	assert.Equal(t, "aggregate", cmd[0].Name)
+	assert.Len(t, cmd, 3)
+	cmd = h.facetCommand(c, bson.M{}, []string{"_id"}, q, 1500*time.Millisecond)
+	assert.Equal(t, bson.DocElem{Name: "maxTimeMS", Value: int64(1500)}, cmd[len(cmd)-1])
+}
+
+func TestFacetable(t *testing.T) {
+	q := &query.Query{Window: &query.Window{Limit: 5}}
+	assert.False(t, NewHandler(&mgo.Session{}, "db", "test").facetable(q))
+	assert.True(t, NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal()).facetable(q))
+	assert.False(t, NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal()).facetable(&query.Query{}))
+	// Aggregations don't support scan limits nor positional projections
+	assert.False(t, NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal(), WithMaxScan(100)).facetable(q))
+	h := NewHandler(&mgo.Session{}, "db", "test", WithConsistentTotal(), WithMatchedElement())
+	assert.True(t, h.facetable(q))
+	q.Predicate = query.MustParsePredicate(`{comments:{$elemMatch:{author:"bob"}}}`)
+	assert.False(t, h.facetable(q))
+}
+
+func TestFindConsistentTotal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindconsistenttotal")()
+	h := NewHandler(s, "testfindconsistenttotal", "test", WithConsistentTotal())
+	items := []*resource.Item{}
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprint(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "even": i%2 == 0}})
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{even:false}`, "id", &query.Window{Limit: 2, Offset: 1})
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, l.Total)
+		if assert.Len(t, l.Items, 2) {
+			assert.Equal(t, "3", l.Items[0].ID)
+			assert.Equal(t, "5", l.Items[1].ID)
+		}
+	}
+
+	// Out of range offset and no match
+	l, err = h.Find(ctx, &query.Query{Window: &query.Window{Limit: 2, Offset: 10}})
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 0)
+		assert.Equal(t, 5, l.Total)
+	}
+	l, err = h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{even:"foo"}`), Window: &query.Window{Limit: 2}})
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 0)
+		assert.Equal(t, 0, l.Total)
+	}
+
+	// Concurrent inserts never make the total disagree with the page
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 6; i <= 200; i++ {
+			id := fmt.Sprint(i)
+			h.Insert(ctx, []*resource.Item{{ID: id, Payload: map[string]interface{}{"id": id}}})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		l, err := h.Find(ctx, &query.Query{Window: &query.Window{Limit: 1000}})
+		require.NoError(t, err)
+		assert.Equal(t, len(l.Items), l.Total)
+	}
+}
+
+func TestFindConsistentTotalProjection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindconsistenttotalprojection")()
+	h := NewHandler(s, "testfindconsistenttotalprojection", "test", WithConsistentTotal(), WithFieldProjection())
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "name": "foo", "age": 1}},
+		{ID: "2", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "2", "name": "bar", "age": 2}},
+	}))
+	l, err := h.Find(ctx, &query.Query{Projection: query.Projection{{Name: "name"}}, Window: &query.Window{Limit: 1}})
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, 2, l.Total)
+		assert.Equal(t, "a", l.Items[0].ETag)
+		assert.Equal(t, map[string]interface{}{"id": "1", "name": "foo"}, l.Items[0].Payload)
+	}
+}
+
+func TestFindConsistentTotalSingleQuery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindconsistenttotalsinglequery")()
+	var mu sync.Mutex
+	sessions := 0
+	logger := func(level, msg string, kv ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		if msg == "session acquired" {
+			sessions++
+		}
+	}
+	items := []*resource.Item{}
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprint(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id}})
+	}
+	ctx := context.Background()
+	require.NoError(t, NewHandler(s, "testfindconsistenttotalsinglequery", "test").Insert(ctx, items))
+	q := &query.Query{Window: &query.Window{Limit: 2}}
+
+	// The count of WithExactTotal runs as a second query
+	h := NewHandler(s, "testfindconsistenttotalsinglequery", "test", WithExactTotal(), WithLogger(logger))
+	l, err := h.Find(ctx, q)
+	require.NoError(t, err)
+	assert.Equal(t, 5, l.Total)
+	assert.Equal(t, 2, sessions)
+
+	// The items and total come back from a single pipeline
+	sessions = 0
+	h = NewHandler(s, "testfindconsistenttotalsinglequery", "test", WithConsistentTotal(), WithLogger(logger))
+	l, err = h.Find(ctx, q)
+	require.NoError(t, err)
+	assert.Len(t, l.Items, 2)
+	assert.Equal(t, 5, l.Total)
+	assert.Equal(t, 1, sessions)
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	blob := []byte{0x00, 0x01, 0xfe, 0xff, 'a'}
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{
+		"id":     "1",
+		"blob":   blob,
+		"nested": map[string]interface{}{"blob": blob},
+	}}
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	mItem, err := h.toMongoItem(item)
+	require.NoError(t, err)
+	b, err := bson.Marshal(mItem)
+	require.NoError(t, err)
+
+	// Stored as a generic BSON binary, not as a string or an array
+	var raw struct {
+		Blob bson.Raw `bson:"blob"`
+	}
+	require.NoError(t, bson.Unmarshal(b, &raw))
+	assert.Equal(t, byte(0x05), raw.Blob.Kind)
+	// Data holds the length, the binary subtype and the bytes
+	assert.Equal(t, byte(0x00), raw.Blob.Data[4])
+	assert.Equal(t, blob, raw.Blob.Data[5:])
+
+	var back mongoItem
+	require.NoError(t, bson.Unmarshal(b, &back))
+	got, err := h.toItem(&back)
+	require.NoError(t, err)
+	assert.Equal(t, blob, got.Payload["blob"])
+	assert.Equal(t, blob, got.Payload["nested"].(map[string]interface{})["blob"])
+}
+
+func TestSliceOfMapsRoundTrip(t *testing.T) {
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{
+		"id": "1",
+		"lines": []map[string]interface{}{
+			{"sku": "a", "qty": 2, "tags": []string{"x", "y"}},
+			{"sku": "b", "qty": 1, "options": []map[string]interface{}{{"color": "red"}}},
+		},
+	}}
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	mItem, err := h.toMongoItem(item)
+	require.NoError(t, err)
+	b, err := bson.Marshal(mItem)
+	require.NoError(t, err)
+
+	// Stored as an array of embedded documents
+	var raw struct {
+		Lines bson.Raw `bson:"lines"`
+	}
+	require.NoError(t, bson.Unmarshal(b, &raw))
+	assert.Equal(t, byte(0x04), raw.Lines.Kind)
+	var elems []bson.Raw
+	require.NoError(t, raw.Lines.Unmarshal(&elems))
+	if assert.Len(t, elems, 2) {
+		assert.Equal(t, byte(0x03), elems[0].Kind)
+		assert.Equal(t, byte(0x03), elems[1].Kind)
+	}
+
+	// Reloaded with the generic types of decoded JSON
+	var back mongoItem
+	require.NoError(t, bson.Unmarshal(b, &back))
+	got, err := h.toItem(&back)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"sku": "a", "qty": 2, "tags": []interface{}{"x", "y"}},
+		map[string]interface{}{"sku": "b", "qty": 1, "options": []interface{}{map[string]interface{}{"color": "red"}}},
+	}, got.Payload["lines"])
+}
+
+func TestInsertSliceOfMaps(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testinsertsliceofmaps")()
+	h := NewHandler(s, "testinsertsliceofmaps", "test")
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{{ID: "1", ETag: "a", Payload: map[string]interface{}{
+		"id":    "1",
+		"lines": []map[string]interface{}{{"sku": "a", "qty": 2}, {"sku": "b", "qty": 1}},
+	}}}))
+
+	l, err := h.Find(ctx, &query.Query{Predicate: query.MustParsePredicate(`{lines.sku:"b"}`)})
+	require.NoError(t, err)
+	if assert.Len(t, l.Items, 1) {
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"sku": "a", "qty": 2},
+			map[string]interface{}{"sku": "b", "qty": 1},
+		}, l.Items[0].Payload["lines"])
+	}
+}
+
+func TestInsertBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testinsertbinary")()
+	h := NewHandler(s, "testinsertbinary", "test")
+	blob := make([]byte, 256)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "blob": blob}}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{item}))
+
+	l, err := h.Find(ctx, &query.Query{})
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, blob, l.Items[0].Payload["blob"])
+	}
+}
+
+func TestFindEach(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindeach")()
+	h := NewHandler(s, "testfindeach", "test")
+	items := []*resource.Item{}
+	for i := 1; i <= 5; i++ {
+		id := fmt.Sprint(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id}})
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", "", "-id", &query.Window{Limit: 3, Offset: 1})
+	require.NoError(t, err)
+	ids := []interface{}{}
+	assert.NoError(t, h.FindEach(ctx, q, func(item *resource.Item) error {
+		ids = append(ids, item.ID)
+		return nil
+	}))
+	assert.Equal(t, []interface{}{"4", "3", "2"}, ids)
+
+	errStop := errors.New("stop")
+	ids = ids[:0]
+	assert.Equal(t, errStop, h.FindEach(ctx, &query.Query{}, func(item *resource.Item) error {
+		ids = append(ids, item.ID)
+		return errStop
+	}))
+	assert.Len(t, ids, 1)
+}
+
+func TestFindEachAggregate(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	q := &query.Query{Aggregate: query.MustParseAggregate(`{category:{$group:true}}`)}
+	err := h.FindEach(context.Background(), q, func(item *resource.Item) error { return nil })
+	assert.Equal(t, resource.ErrNotImplemented, err)
+}
+
+func TestFindEachNoCursorTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindeachnocursortimeout")()
+	// Have the server time out idle cursors after 500ms instead of 10 minutes
+	var res bson.M
+	require.NoError(t, s.Run(bson.D{{Name: "setParameter", Value: 1}, {Name: "cursorTimeoutMillis", Value: 500}}, &res))
+	defer s.Run(bson.D{{Name: "setParameter", Value: 1}, {Name: "cursorTimeoutMillis", Value: 600000}}, &res)
+
+	c := s.DB("testfindeachnocursortimeout").C("test")
+	// More than the first batch of 101 documents so a getMore is needed
+	for i := 0; i < 200; i++ {
+		require.NoError(t, c.Insert(bson.M{"_id": i}))
+	}
+	slow := func(item *resource.Item) error {
+		if item.ID == 0 {
+			// Let the server cursor monitor run (every 4s by default)
+			time.Sleep(6 * time.Second)
+		}
+		return nil
+	}
+	ctx := context.Background()
+	q := &query.Query{}
+
+	h := NewHandler(s, "testfindeachnocursortimeout", "test")
+	assert.Error(t, h.FindEach(ctx, q, slow))
+
+	h = NewHandler(s, "testfindeachnocursortimeout", "test", WithNoCursorTimeout())
+	assert.NoError(t, h.FindEach(ctx, q, slow))
+}
+
+func TestWithDatabase(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	c, err := h.WithDatabase("tenant1").collection(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "tenant1", c.Database.Name)
+		assert.Equal(t, "test", c.Name)
+	}
+	// The original handler is left untouched
+	c, err = h.collection(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "db", c.Database.Name)
+	}
+	_, err = h.WithDatabase("invalid.db").collection(context.Background())
+	assert.IsType(t, &NameError{}, err)
+}
+
+func TestWithDatabaseInsert(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testwithdatabase1")()
+	defer cleanup(s, "testwithdatabase2")()
+	h := NewHandler(s, "testwithdatabase", "test")
+	ctx := context.Background()
+	require.NoError(t, h.WithDatabase("testwithdatabase1").Insert(ctx, []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tenant": 1}},
+	}))
+	require.NoError(t, h.WithDatabase("testwithdatabase2").Insert(ctx, []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tenant": 2}},
+	}))
+
+	for _, tenant := range []int{1, 2} {
+		d := bson.M{}
+		require.NoError(t, s.DB(fmt.Sprintf("testwithdatabase%d", tenant)).C("test").FindId("1").One(&d))
+		assert.Equal(t, tenant, d["tenant"])
+	}
+	n, err := s.DB("testwithdatabase").C("test").Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestExists(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testexists")()
+	oid := bson.NewObjectId()
+	h := NewHandler(s, "testexists", "test", WithObjectID())
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: oid, Payload: map[string]interface{}{"id": oid}},
+	}))
+
+	found, err := h.Exists(ctx, oid)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	// Hex string ids are converted
+	found, err = h.Exists(ctx, oid.Hex())
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = h.Exists(ctx, bson.NewObjectId().Hex())
+	assert.NoError(t, err)
+	assert.False(t, found)
+	_, err = h.Exists(ctx, "foo")
+	assert.EqualError(t, err, `invalid object id: "foo"`)
+}
+
+func TestWithPrefetch(t *testing.T) {
+	prefetch := func(mq *mgo.Query) float64 {
+		// mgo doesn't expose the prefetch ratio of a query
+		return reflect.ValueOf(mq).Elem().FieldByName("query").FieldByName("prefetch").Float()
+	}
+	c := (&mgo.Session{}).DB("db").C("test")
+	h := NewHandler(&mgo.Session{}, "db", "test", WithPrefetch(0.75))
+	assert.Equal(t, 0.75, prefetch(h.find(c, bson.M{}, []string{"_id"}, &query.Query{})))
+	h = NewHandler(&mgo.Session{}, "db", "test", WithPrefetch(0))
+	assert.Equal(t, 0.0, prefetch(h.find(c, bson.M{}, []string{"_id"}, &query.Query{})))
+
+	for _, p := range []float64{-0.1, 1.5} {
+		h = NewHandler(&mgo.Session{}, "db", "test", WithPrefetch(p))
+		_, err := h.collection(context.Background())
+		assert.EqualError(t, err, fmt.Sprintf("invalid prefetch %v: must be between 0 and 1", p))
+	}
+}
+
+func TestAutocomplete(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testautocomplete")()
+	h := NewHandler(s, "testautocomplete", "test")
+	items := []*resource.Item{}
+	for i, name := range []string{"paris", "pau", "paris", "lyon", "pa.ris", "Paris"} {
+		id := fmt.Sprint(i)
+		items = append(items, &resource.Item{ID: id, Payload: map[string]interface{}{"id": id, "city": name}})
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	values, err := h.Autocomplete(ctx, "city", "pa", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"pa.ris", "paris", "pau"}, values)
+	values, err = h.Autocomplete(ctx, "city", "pa", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"pa.ris"}, values)
+	// The prefix is not interpreted as a regex
+	values, err = h.Autocomplete(ctx, "city", "pa.", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"pa.ris"}, values)
+	values, err = h.Autocomplete(ctx, "city", ".*", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, values)
+}
+
+func TestFindRawDocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindrawdocs")()
+	h := NewHandler(s, "testfindrawdocs", "test")
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+		{ID: "2", ETag: "b", Updated: now, Payload: map[string]interface{}{"id": "2", "foo": "baz"}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{foo:"bar"}`, "", nil)
+	require.NoError(t, err)
+	docs, err := h.FindRawDocs(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, docs, 1) {
+		d := docs[0]
+		assert.Equal(t, "1", d["_id"])
+		assert.Equal(t, "a", d["_etag"])
+		assert.IsType(t, time.Time{}, d["_updated"])
+		assert.Equal(t, "bar", d["foo"])
+		// No payload reshaping
+		assert.NotContains(t, d, "id")
+	}
+}
+
+func TestFindRawDocsOptions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindrawdocsoptions")()
+	db := s.DB("testfindrawdocsoptions")
+	require.NoError(t, db.C("test").EnsureIndexKey("foo", "-_updated"))
+	h := NewHandler(s, "testfindrawdocsoptions", "test")
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+	}))
+	// Profile all the operations to read the executed query back
+	require.NoError(t, db.Run(bson.D{{Name: "profile", Value: 2}}, nil))
+	defer db.Run(bson.D{{Name: "profile", Value: 0}}, nil)
+
+	q, err := query.New("", `{foo:"bar"}`, "", nil)
+	require.NoError(t, err)
+	docs, err := h.FindRawDocs(ctx, q, RawHint("foo", "-_updated"), RawComment("raw docs test"))
+	if assert.NoError(t, err) {
+		assert.Len(t, docs, 1)
+	}
+	var op bson.M
+	err = db.C("system.profile").Find(bson.M{"ns": "testfindrawdocsoptions.test", "op": "query"}).Sort("-ts").One(&op)
+	if assert.NoError(t, err) {
+		cmd, _ := op["command"].(bson.M)
+		if cmd == nil {
+			// Servers before 3.2 profile the query document
+			cmd, _ = op["query"].(bson.M)
+		}
+		assert.Equal(t, "raw docs test", cmd["comment"])
+		assert.Equal(t, bson.M{"foo": 1, "_updated": -1}, cmd["hint"])
+	}
+
+	// Hinting a missing index fails
+	_, err = h.FindRawDocs(ctx, q, RawHint("bar"))
+	assert.Error(t, err)
+}
+
+func TestRawHint(t *testing.T) {
+	hint, err := rawHint([]string{"id", "-updated", "a.b"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"_id", "-updated", "a.b"}, hint)
+	for _, k := range []string{"", "-", "$text:title", "@loc", "+a"} {
+		_, err = rawHint([]string{k})
+		assert.EqualError(t, err, fmt.Sprintf("invalid hint key %q", k))
+	}
+}
+
+func TestItemSelectorShardKey(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithShardKey([]string{"tenant", "region"}))
+	original := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "tenant": "t1"}}
+	next := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "tenant": "t2", "region": "eu"}}
+	s, err := h.itemSelector(original, next)
+	assert.NoError(t, err)
+	// The stored values take precedence
+	assert.Equal(t, bson.M{"_id": "1", "_etag": "a", "tenant": "t1", "region": "eu"}, s)
+	s, err = h.itemSelector(original, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "_etag": "a", "tenant": "t1"}, s)
+}
+
+func TestMustFind(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testmustfind")()
+	h := NewHandler(s, "testmustfind", "test")
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "foo": "bar"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "foo": "bar"}},
+	}))
+
+	q, err := query.New("", `{foo:"bar"}`, "", nil)
+	require.NoError(t, err)
+	l, err := h.MustFind(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 2)
+	}
+	q, err = query.New("", `{foo:"bar"}`, "", &query.Window{Limit: 0})
+	require.NoError(t, err)
+	l, err = h.MustFind(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, l.Total)
+	}
+	// Matching items exist beyond the requested page
+	q, err = query.New("", `{foo:"bar"}`, "", &query.Window{Limit: 10, Offset: 5})
+	require.NoError(t, err)
+	l, err = h.MustFind(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 0)
+		assert.Equal(t, 2, l.Total)
+	}
+
+	q, err = query.New("", `{foo:"baz"}`, "", nil)
+	require.NoError(t, err)
+	_, err = h.MustFind(ctx, q)
+	assert.Equal(t, resource.ErrNotFound, err)
+	q, err = query.New("", `{foo:"baz"}`, "", &query.Window{Limit: 0})
+	require.NoError(t, err)
+	_, err = h.MustFind(ctx, q)
+	assert.Equal(t, resource.ErrNotFound, err)
+	q, err = query.New("", `{foo:"baz"}`, "", &query.Window{Limit: 10, Offset: 5})
+	require.NoError(t, err)
+	_, err = h.MustFind(ctx, q)
+	assert.Equal(t, resource.ErrNotFound, err)
+}
+
+func TestFindInArray(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindinarray")()
+	h := NewHandler(s, "testfindinarray", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tags": []interface{}{"a", "c"}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tags": []interface{}{"b"}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "tags": []interface{}{"c", "d"}}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "tags": []interface{}{"a", "b"}}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{tags:{$in:["a","b"]}}`, "id", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		ids := []interface{}{}
+		for _, item := range l.Items {
+			ids = append(ids, item.ID)
+		}
+		// Any item containing a or b matches, not only those equal to [a, b]
+		assert.Equal(t, []interface{}{"1", "2", "4"}, ids)
+	}
+}
+
+func TestFindNonEmptyArray(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindnonemptyarray")()
+	h := NewHandler(s, "testfindnonemptyarray", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tags": []interface{}{"a"}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tags": []interface{}{}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3"}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "tags": []interface{}{"b", "c"}}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{tags.0:{$exists:true}}`, "id", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		ids := []interface{}{}
+		for _, item := range l.Items {
+			ids = append(ids, item.ID)
+		}
+		assert.Equal(t, []interface{}{"1", "4"}, ids)
+	}
+}
+
+func TestFindMapKey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindmapkey")()
+	h := NewHandler(s, "testfindmapkey", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "attrs": map[string]interface{}{"color": "red", "size": 10}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "attrs": map[string]interface{}{"color": "blue"}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "attrs": map[string]interface{}{"weight": 3, "color": "red"}}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4"}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{attrs.color:"red"}`, "id", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 2) {
+		// The whole map is returned
+		assert.Equal(t, map[string]interface{}{"color": "red", "size": 10}, l.Items[0].Payload["attrs"])
+		assert.Equal(t, map[string]interface{}{"weight": 3, "color": "red"}, l.Items[1].Payload["attrs"])
+	}
+
+	q, err = query.New("", `{attrs.weight:{$exists:true}}`, "", nil)
+	require.NoError(t, err)
+	l, err = h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "3", l.Items[0].ID)
+	}
+}
+
+func TestGroupPipelineUnwind(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithUnwind("tags", "meta.labels"))
+	grp := bson.M{"_id": "$tags", "total": bson.M{"$sum": 1}}
+	assert.Equal(t, []bson.M{
+		{"$match": bson.M{"active": true}},
+		{"$unwind": "$tags"},
+		{"$unwind": "$meta.labels"},
+		{"$group": grp},
+	}, h.groupPipeline(bson.M{"active": true}, grp))
+
+	for _, f := range []string{"", "tags.", "a..b", "$tags", "a.$b"} {
+		h = NewHandler(&mgo.Session{}, "db", "test", WithUnwind(f))
+		_, err := h.collection(context.Background())
+		assert.Error(t, err, f)
+	}
+}
+
+func TestGroupCountUnwind(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testgroupcountunwind")()
+	h := NewHandler(s, "testgroupcountunwind", "test", WithUnwind("tags"))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "tags": []interface{}{"a", "b"}}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "tags": []interface{}{"a"}}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "tags": []interface{}{"b", "c", "a"}}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	counts, err := h.GroupCount(ctx, &query.Query{}, "tags")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]int{"a": 3, "b": 2, "c": 1}, counts)
+	}
+
+	q := &query.Query{Aggregate: query.MustParseAggregate(`{tags:{$group:true}}`)}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) {
+		assert.Len(t, l.Items, 3)
+	}
+}
+
+func TestDistinctCount(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testdistinctcount")()
+	h := NewHandler(s, "testdistinctcount", "test")
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "city": "paris", "active": true}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "city": "paris", "active": true}},
+		{ID: "3", Payload: map[string]interface{}{"id": "3", "city": "lyon", "active": true}},
+		{ID: "4", Payload: map[string]interface{}{"id": "4", "city": "nice", "active": false}},
+		{ID: "5", Payload: map[string]interface{}{"id": "5", "active": true}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	n, err := h.DistinctCount(ctx, &query.Query{}, "city")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	q, err := query.New("", `{active:true}`, "", nil)
+	require.NoError(t, err)
+	n, err = h.DistinctCount(ctx, q, "city")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	q, err = query.New("", `{city:"marseille"}`, "", nil)
+	require.NoError(t, err)
+	n, err = h.DistinctCount(ctx, q, "city")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestFindLooseBool(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindloosebool")()
+	c := s.DB("testfindloosebool").C("test")
+	require.NoError(t, c.Insert(
+		bson.M{"_id": "1", "active": true},
+		bson.M{"_id": "2", "active": 1},
+		bson.M{"_id": "3", "active": false},
+		bson.M{"_id": "4", "active": 0},
+	))
+	h := NewHandler(s, "testfindloosebool", "test", WithLooseBoolFields([]string{"active"}))
+	ctx := context.Background()
+
+	q, err := query.New("", `{active:true}`, "id", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 2) {
+		assert.Equal(t, "1", l.Items[0].ID)
+		assert.Equal(t, "2", l.Items[1].ID)
+	}
+
+	q, err = query.New("", `{active:false}`, "id", nil)
+	require.NoError(t, err)
+	l, err = h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 2) {
+		assert.Equal(t, "3", l.Items[0].ID)
+		assert.Equal(t, "4", l.Items[1].ID)
+	}
+}
+
+func TestFindIntFields(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindintfields")()
+	c := s.DB("testfindintfields").C("test")
+	require.NoError(t, c.Insert(
+		bson.M{"_id": "1", "age": int32(1)},
+		bson.M{"_id": "2", "age": int32(2)},
+	))
+	h := NewHandler(s, "testfindintfields", "test", WithIntFields([]string{"age"}))
+	ctx := context.Background()
+
+	q, err := query.New("", `{age:1}`, "", nil)
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "1", l.Items[0].ID)
+	}
+
+	q, err = query.New("", `{age:{$gt:1}}`, "", nil)
+	require.NoError(t, err)
+	l, err = h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "2", l.Items[0].ID)
+	}
+}
+
+func TestMaxDocumentSize(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithMaxDocumentSize(100))
+	small := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1"}}
+	_, err := h.toMongoItem(small)
+	assert.NoError(t, err)
+
+	big := &resource.Item{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "data": strings.Repeat("x", 100)}}
+	err = h.Insert(context.Background(), []*resource.Item{small, big})
+	if sErr, ok := err.(*DocumentSizeError); assert.True(t, ok, "got %v", err) {
+		assert.Equal(t, "2", sErr.ID)
+		assert.True(t, sErr.Size > 100)
+		assert.Equal(t, 100, sErr.Max)
+		assert.EqualError(t, err, fmt.Sprintf("item 2: document size %d exceeds the limit of 100 bytes", sErr.Size))
+	}
+	err = h.Update(context.Background(), big, small)
+	assert.IsType(t, &DocumentSizeError{}, err)
+
+	for _, n := range []int{0, -1} {
+		h = NewHandler(&mgo.Session{}, "db", "test", WithMaxDocumentSize(n))
+		_, err := h.collection(context.Background())
+		assert.EqualError(t, err, fmt.Sprintf("invalid max document size %d: must be positive", n))
+	}
+}
+
+func TestFindProjection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindprojection")()
+	h := NewHandler(s, "testfindprojection", "test", WithFieldProjection())
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Updated: now, Payload: map[string]interface{}{
+			"id":      "1",
+			"name":    "foo",
+			"age":     1,
+			"address": map[string]interface{}{"city": "NYC", "zip": "10001"},
+		}},
+	}))
+
+	q := &query.Query{Projection: query.Projection{
+		{Name: "name"},
+		{Name: "address", Children: query.Projection{{Name: "city"}}},
+	}}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, "1", l.Items[0].ID)
+		assert.Equal(t, "a", l.Items[0].ETag)
+		assert.Equal(t, now, l.Items[0].Updated)
+		assert.Equal(t, map[string]interface{}{
+			"id":      "1",
+			"name":    "foo",
+			"address": map[string]interface{}{"city": "NYC"},
+		}, l.Items[0].Payload)
+	}
+}
+
+func TestFindCoveredProjection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindcoveredprojection")()
+	c := s.DB("testfindcoveredprojection").C("test")
+	require.NoError(t, c.EnsureIndexKey("name"))
+	h := NewHandler(s, "testfindcoveredprojection", "test", WithCoveredProjection())
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "foo", "age": 1}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "bar", "age": 2}},
+	}))
+
+	q := &query.Query{
+		Predicate:  query.MustParsePredicate(`{name:"foo"}`),
+		Projection: query.Projection{{Name: "name"}},
+	}
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Nil(t, l.Items[0].ID)
+		assert.Equal(t, map[string]interface{}{"id": nil, "name": "foo"}, l.Items[0].Payload)
+	}
+}
+
+// fakeIter returns docs, then fails with err.
+type fakeIter struct {
+	docs []mongoItem
+	err  error
+}
+
+func (i *fakeIter) Next(result interface{}) bool {
+	if len(i.docs) == 0 {
+		return false
+	}
+	*result.(*mongoItem) = i.docs[0]
+	i.docs = i.docs[1:]
+	return true
+}
+
+func (i *fakeIter) Close() error {
+	return i.err
+}
+
+func TestEachCursorRetry(t *testing.T) {
+	docs := []mongoItem{}
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		docs = append(docs, mongoItem{ID: id, Payload: map[string]interface{}{}})
+	}
+	ctx := context.Background()
+	var skips []int
+	var ids []interface{}
+	// The cursor is killed after 2 items
+	open := func(skip int) iterator {
+		skips = append(skips, skip)
+		if skip == 0 {
+			return &fakeIter{docs: docs[:2], err: mgo.ErrCursor}
+		}
+		return &fakeIter{docs: docs[skip:]}
+	}
+	fn := func(item *resource.Item) error {
+		ids = append(ids, item.ID)
+		return nil
+	}
+
+	h := NewHandler(&mgo.Session{}, "db", "test", WithCursorRetry())
+	assert.NoError(t, h.each(ctx, open, fn))
+	assert.Equal(t, []int{0, 2}, skips)
+	assert.Equal(t, []interface{}{"1", "2", "3", "4", "5"}, ids)
+
+	// Without the option, the iteration fails
+	skips, ids = nil, nil
+	h = NewHandler(&mgo.Session{}, "db", "test")
+	assert.Equal(t, mgo.ErrCursor, h.each(ctx, open, fn))
+	assert.Equal(t, []int{0}, skips)
+	assert.Equal(t, []interface{}{"1", "2"}, ids)
+
+	// Give up after a few retries
+	skips = nil
+	h = NewHandler(&mgo.Session{}, "db", "test", WithCursorRetry())
+	killed := &mgo.QueryError{Code: 43, Message: "cursor id 123 not found"}
+	err := h.each(ctx, func(skip int) iterator {
+		skips = append(skips, skip)
+		return &fakeIter{err: killed}
+	}, fn)
+	assert.Equal(t, killed, err)
+	assert.Len(t, skips, cursorRetries+1)
+
+	// Nothing left to read
+	err = h.each(ctx, func(skip int) iterator {
+		if skip > 0 {
+			return nil
+		}
+		return &fakeIter{docs: docs[:1], err: mgo.ErrCursor}
+	}, fn)
+	assert.NoError(t, err)
+}
+
+func TestSkipWindow(t *testing.T) {
+	q := &query.Query{}
+	rq, ok := skipWindow(q, 0)
+	assert.True(t, ok)
+	assert.Equal(t, q, rq)
+	rq, ok = skipWindow(q, 5)
+	assert.True(t, ok)
+	assert.Equal(t, &query.Window{Offset: 5, Limit: -1}, rq.Window)
+	assert.Nil(t, q.Window)
+
+	q.Window = &query.Window{Offset: 10, Limit: 20}
+	rq, ok = skipWindow(q, 5)
+	assert.True(t, ok)
+	assert.Equal(t, &query.Window{Offset: 15, Limit: 15}, rq.Window)
+	assert.Equal(t, &query.Window{Offset: 10, Limit: 20}, q.Window)
+	_, ok = skipWindow(q, 20)
+	assert.False(t, ok)
+
+	q.Window = &query.Window{Limit: -1}
+	rq, ok = skipWindow(q, 5)
+	assert.True(t, ok)
+	assert.Equal(t, &query.Window{Offset: 5, Limit: -1}, rq.Window)
+}
+
+func TestMutationHook(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testmutationhook")()
+	type call struct {
+		op  string
+		ids []interface{}
+	}
+	var calls []call
+	h := NewHandler(s, "testmutationhook", "test", WithMutationHook(func(op string, ids []interface{}) {
+		calls = append(calls, call{op, ids})
+	}))
+	ctx := context.Background()
+	item1 := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1"}}
+	item2 := &resource.Item{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2"}}
+	require.NoError(t, h.Insert(ctx, []*resource.Item{item1, item2}))
+	assert.Equal(t, []call{{"insert", []interface{}{"1", "2"}}}, calls)
+
+	calls = nil
+	next := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "foo": "bar"}}
+	require.NoError(t, h.Update(ctx, next, item1))
+	_, err = h.UpdateReturnOld(ctx, &resource.Item{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2"}}, item2)
+	require.NoError(t, err)
+	require.NoError(t, h.Delete(ctx, next))
+	assert.Equal(t, []call{
+		{"update", []interface{}{"1"}},
+		{"update", []interface{}{"2"}},
+		{"delete", []interface{}{"1"}},
+	}, calls)
+
+	// Failed writes don't call the hook
+	calls = nil
+	assert.Equal(t, resource.ErrConflict, h.Insert(ctx, []*resource.Item{item2}))
+	assert.Equal(t, resource.ErrConflict, h.Update(ctx, next, item2))
+	assert.Equal(t, resource.ErrNotFound, h.Delete(ctx, next))
+	assert.Empty(t, calls)
+
+	// Only the inserted items of an unordered insert are reported
+	h = NewHandler(s, "testmutationhook", "test", WithUnorderedBulk(), WithMutationHook(func(op string, ids []interface{}) {
+		calls = append(calls, call{op, ids})
+	}))
+	item3 := &resource.Item{ID: "3", ETag: "a", Payload: map[string]interface{}{"id": "3"}}
+	assert.IsType(t, &InsertError{}, h.Insert(ctx, []*resource.Item{item2, item3}))
+	assert.Equal(t, []call{{"insert", []interface{}{"3"}}}, calls)
+}
+
+func TestTimePrecision(t *testing.T) {
+	updated := time.Date(2018, 1, 1, 10, 20, 30, 456789000, time.UTC)
+	item := &resource.Item{ID: "1", Updated: updated, Payload: map[string]interface{}{"id": "1"}}
+
+	h := NewHandler(&mgo.Session{}, "db", "test", WithTimePrecision(time.Second))
+	mItem, err := h.toMongoItem(item)
+	if assert.NoError(t, err) {
+		assert.Equal(t, time.Date(2018, 1, 1, 10, 20, 30, 0, time.UTC), mItem.Updated)
+	}
+
+	// Without the option, the BSON encoding is left in charge of the precision
+	h = NewHandler(&mgo.Session{}, "db", "test")
+	mItem, err = h.toMongoItem(item)
+	if assert.NoError(t, err) {
+		assert.Equal(t, updated, mItem.Updated)
+	}
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithDefaultTimeout(time.Minute))
+
+	ctx, cancel := h.context(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if assert.True(t, ok, "default timeout not applied") {
+		assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+	}
+
+	// Existing deadlines are honored
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelParent()
+	ctx, cancel = h.context(parent)
+	defer cancel()
+	assert.True(t, ctx == parent)
+
+	// No default timeout without the option
+	h = NewHandler(&mgo.Session{}, "db", "test")
+	ctx, cancel = h.context(context.Background())
+	defer cancel()
+	_, ok = ctx.Deadline()
+	assert.False(t, ok)
+}
+
+func TestFindComputedFields(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindcomputedfields")()
+	h := NewHandler(s, "testfindcomputedfields", "test", WithComputedFields(map[string]bson.M{
+		"fullName": {"$concat": []string{"$first", " ", "$last"}},
+	}))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "first": "John", "last": "Doe"}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "first": "Jane", "last": "Roe"}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	q, err := query.New("", `{last:"Roe"}`, "", query.Page(1, 10, 0))
+	require.NoError(t, err)
+	l, err := h.Find(ctx, q)
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, map[string]interface{}{"id": "2", "first": "Jane", "last": "Roe", "fullName": "Jane Roe"}, l.Items[0].Payload)
+	}
+}
+
+func TestHandlerClose(t *testing.T) {
+	s := &mgo.Session{}
+	h := NewHandler(s, "db", "test")
+	h.Close()
+	_, err := h.Find(context.Background(), &query.Query{})
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, h.Insert(context.Background(), []*resource.Item{{ID: "1"}}))
+
+	// Other handlers sharing the session are not affected
+	assert.False(t, NewHandler(s, "db", "test").closed())
+}
+
+func TestUpdateReturnOld(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testupdatereturnold")()
+	h := NewHandler(s, "testupdatereturnold", "test")
+	oldItem := &resource.Item{
+		ID:      "1234",
+		ETag:    "etag1",
+		Updated: now,
+		Payload: map[string]interface{}{"id": "1234", "foo": "bar"},
+	}
+	newItem := &resource.Item{
+		ID:      "1234",
+		ETag:    "etag2",
+		Updated: now,
+		Payload: map[string]interface{}{"id": "1234", "foo": "baz"},
+	}
+	ctx := context.Background()
+
+	_, err = h.UpdateReturnOld(ctx, newItem, oldItem)
+	assert.Equal(t, resource.ErrNotFound, err)
+
+	require.NoError(t, h.Insert(ctx, []*resource.Item{oldItem}))
+	old, err := h.UpdateReturnOld(ctx, newItem, oldItem)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "etag1", old.ETag)
+		assert.Equal(t, map[string]interface{}{"id": "1234", "foo": "bar"}, old.Payload)
+	}
+
+	d := map[string]interface{}{}
+	require.NoError(t, s.DB("testupdatereturnold").C("test").FindId("1234").One(&d))
+	assert.Equal(t, "baz", d["foo"])
+
+	// Etag mismatch
+	_, err = h.UpdateReturnOld(ctx, newItem, oldItem)
+	assert.Equal(t, resource.ErrConflict, err)
+}
+
+func TestWithSliceInvalid(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(&mgo.Session{}, "db", "test", WithSlice("comments"))
+	_, err := h.Find(ctx, &query.Query{})
+	assert.EqualError(t, err, "comments: invalid $slice: 1 or 2 arguments expected, got 0")
+
+	h = NewHandler(&mgo.Session{}, "db", "test", WithSlice("comments", 1, 0))
+	_, err = h.Find(ctx, &query.Query{})
+	assert.EqualError(t, err, "comments: invalid $slice: number of elements to return must be positive")
+}
+
+func TestFindSlice(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfindslice")()
+	h := NewHandler(s, "testfindslice", "test", WithSlice("comments", 2))
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "comments": []string{"a", "b", "c", "d"}}},
+	}
+	ctx := context.Background()
+	require.NoError(t, h.Insert(ctx, items))
+
+	l, err := h.Find(ctx, &query.Query{})
+	if assert.NoError(t, err) && assert.Len(t, l.Items, 1) {
+		assert.Equal(t, []interface{}{"a", "b"}, l.Items[0].Payload["comments"])
+	}
+}
@@ -0,0 +1,66 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NameError is returned when a database or collection name doesn't follow the
+// MongoDB naming restrictions:
+// https://docs.mongodb.com/manual/reference/limits/#naming-restrictions
+type NameError struct {
+	// Kind is either "database" or "collection".
+	Kind   string
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("invalid %s name %q: %s", e.Kind, e.Name, e.Reason)
+}
+
+// validateNames checks db and collection against the MongoDB naming rules.
+func validateNames(db, collection string) error {
+	if err := validateDBName(db); err != nil {
+		return err
+	}
+	switch {
+	case collection == "":
+		return &NameError{"collection", collection, "empty name"}
+	case strings.ContainsAny(collection, "$\x00"):
+		return &NameError{"collection", collection, "name contains an invalid character"}
+	case strings.HasPrefix(collection, "system."):
+		return &NameError{"collection", collection, "system. prefix is reserved"}
+	}
+	return nil
+}
+
+// validateDBName checks db against the MongoDB database naming rules.
+func validateDBName(db string) error {
+	switch {
+	case db == "":
+		return &NameError{"database", db, "empty name"}
+	case len(db) >= 64:
+		return &NameError{"database", db, "name must be shorter than 64 characters"}
+	case strings.ContainsAny(db, "/\\. \"$*<>:|?\x00"):
+		return &NameError{"database", db, "name contains an invalid character"}
+	}
+	return nil
+}
+
+// validateFieldPath checks that f is a valid dot separated field path.
+func validateFieldPath(f string) error {
+	if f == "" {
+		return errors.New("invalid field path: empty path")
+	}
+	for _, p := range strings.Split(f, ".") {
+		if p == "" {
+			return fmt.Errorf("invalid field path %q: empty field name", f)
+		}
+		if strings.HasPrefix(p, "$") {
+			return fmt.Errorf("invalid field path %q: field names can't start with $", f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+)
+
+func TestValidateNames(t *testing.T) {
+	cases := []struct {
+		db, collection string
+		err            error
+	}{
+		{"db", "test", nil},
+		{"db", "foo.bar", nil},
+		{"", "test", &NameError{"database", "", "empty name"}},
+		{"db", "", &NameError{"collection", "", "empty name"}},
+		{"my.db", "test", &NameError{"database", "my.db", "name contains an invalid character"}},
+		{"my db", "test", &NameError{"database", "my db", "name contains an invalid character"}},
+		{"db", "te$t", &NameError{"collection", "te$t", "name contains an invalid character"}},
+		{"db", "system.users", &NameError{"collection", "system.users", "system. prefix is reserved"}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.db+"/"+tc.collection, func(t *testing.T) {
+			assert.Equal(t, tc.err, validateNames(tc.db, tc.collection))
+		})
+	}
+}
+
+func TestNewHandlerInvalidName(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "")
+	_, err := h.Find(context.Background(), &query.Query{})
+	assert.Equal(t, &NameError{"collection", "", "empty name"}, err)
+
+	_, err = NewHandlerContext(context.Background(), "mongodb://localhost", "in/valid", "test")
+	assert.Equal(t, &NameError{"database", "in/valid", "name contains an invalid character"}, err)
+}
+
+func TestNewHandlerE(t *testing.T) {
+	_, err := NewHandlerE(&mgo.Session{}, "db", "system.users")
+	assert.Equal(t, &NameError{"collection", "system.users", "system. prefix is reserved"}, err)
+	_, err = NewHandlerE(&mgo.Session{}, "db", "test", WithSlice("tags"))
+	assert.Error(t, err)
+	_, err = NewHandlerE(&mgo.Session{}, "db", "test", WithSlice("tags", 5))
+	assert.NoError(t, err)
+
+	_, err = NewHandlerContext(context.Background(), "mongodb://localhost", "db", "test", WithSlice("tags"))
+	assert.Error(t, err)
+}
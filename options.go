@@ -0,0 +1,607 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oktacode/rest-layer/schema"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrMaxOffsetExceeded is returned when a query window requests an offset
+// greater than the one allowed with WithMaxOffset.
+var ErrMaxOffsetExceeded = errors.New("offset exceeds the maximum allowed")
+
+// ErrScanLimitExceeded is returned by Find when the query stopped after
+// examining the number of documents allowed with WithMaxScan before the
+// requested page could be filled.
+var ErrScanLimitExceeded = errors.New("scan limit exceeded")
+
+// Option configures a Handler.
+type Option func(h *Handler)
+
+// WithMaxOffset limits the offset a query window may request to n. Queries
+// asking for a greater offset fail with ErrMaxOffsetExceeded instead of
+// having MongoDB skip over a potentially huge number of documents. A value of
+// 0 or less disables the limit.
+func WithMaxOffset(n int) Option {
+	return func(h *Handler) {
+		h.maxOffset = n
+	}
+}
+
+// WithReadTags has Find, FindEach and Count read from the replica set members
+// matching one of the given tag sets, tried in order, for instance to read
+// from the members of the local data center. mode must allow reading from the
+// members selected by the tags, i.e. be mgo.Nearest, mgo.Secondary or
+// mgo.SecondaryPreferred (mgo.PrimaryPreferred only applies the tags when the
+// primary is unavailable). The tags are configured on the members of the
+// replica set (see the members[n].tags setting). Reads fail when no member
+// matches the tags before the operation times out. Writes are not affected.
+// Other modes are rejected.
+func WithReadTags(mode mgo.Mode, tags ...bson.D) Option {
+	return func(h *Handler) {
+		switch mode {
+		case mgo.Nearest, mgo.Secondary, mgo.SecondaryPreferred, mgo.PrimaryPreferred:
+		default:
+			h.err = errors.New("invalid read mode: tags only apply to the Nearest, Secondary, SecondaryPreferred and PrimaryPreferred modes")
+			return
+		}
+		h.readMode = mode
+		h.readTags = tags
+	}
+}
+
+// WithMaxScan limits to n the number of documents or index keys a query of Find
+// and FindEach may examine, using the $maxScan modifier, to protect the server
+// against runaway scans of unindexed queries. Find fails with
+// ErrScanLimitExceeded when the limit is hit before the requested page could be
+// filled, while FindEach silently stops. It does not apply to aggregate queries
+// nor to handlers using computed fields or a collation. $maxScan was removed in
+// MongoDB 4.2, where WithDefaultTimeout may be used instead.
+func WithMaxScan(n int) Option {
+	return func(h *Handler) {
+		h.maxScan = n
+	}
+}
+
+// WithMaxDocumentSize limits to n bytes the BSON size of the documents written
+// by Insert, Update, UpdateReturnOld and UpsertMany. Items whose document
+// exceeds the limit are rejected with a *DocumentSizeError before anything is
+// sent to the server, for instance to keep well below the 16MB server limit.
+func WithMaxDocumentSize(n int) Option {
+	return func(h *Handler) {
+		if n <= 0 {
+			h.err = fmt.Errorf("invalid max document size %d: must be positive", n)
+			return
+		}
+		h.maxDocumentSize = n
+	}
+}
+
+// ErrUnfilteredClear is returned by Clear and ClearProgress, when
+// WithRequirePredicateOnClear is set, for queries whose filter would match all
+// the items.
+var ErrUnfilteredClear = errors.New("clear without filter")
+
+// WithRequirePredicateOnClear makes Clear and ClearProgress fail with
+// ErrUnfilteredClear when the query has no filter, to prevent deleting the
+// whole collection by mistake. Such queries remain allowed with a context
+// returned by AllowUnfilteredClear.
+func WithRequirePredicateOnClear() Option {
+	return func(h *Handler) {
+		h.requirePredicateOnClear = true
+	}
+}
+
+// WithObjectID tells the handler that item IDs are stored as bson.ObjectId.
+// Hex string comparands used against the id field in predicates, including
+// each element of $in and $nin lists, are then converted to bson.ObjectId. An
+// invalid hex string makes the query fail.
+func WithObjectID() Option {
+	return func(h *Handler) {
+		h.objectID = true
+	}
+}
+
+// WithIDCodec sets the functions converting the item ids, which must be
+// strings, to and from the representation stored in the _id field, for
+// instance to store UUIDs as BSON binaries. The ids are encoded on Insert,
+// Update and Delete, as are the comparands used against the id field in
+// predicates, including $in and $nin lists, and decoded by Find.
+func WithIDCodec(encode func(string) (interface{}, error), decode func(interface{}) (string, error)) Option {
+	return func(h *Handler) {
+		h.idEncode = encode
+		h.idDecode = decode
+	}
+}
+
+// WithObjectIDFields declares reference fields, like those linking a
+// sub-resource to its parent, storing the bson.ObjectId of the referenced
+// items. Hex string comparands used against those fields in predicates are
+// converted to bson.ObjectId the same way WithObjectID does for the id field.
+func WithObjectIDFields(fields []string) Option {
+	return func(h *Handler) {
+		h.objectIDFields = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			h.objectIDFields[f] = true
+		}
+	}
+}
+
+// WithEnumMapping stores the string values of the enum field as the integers
+// they are mapped to by values, for instance to make its index smaller. Values
+// are converted on Insert and Update and back by Find, and string comparands
+// used against the field in predicates are converted as well. Values missing
+// from the mapping make the operation fail.
+func WithEnumMapping(field string, values map[string]int) Option {
+	return func(h *Handler) {
+		e := enumMapping{
+			values: make(map[string]int, len(values)),
+			names:  make(map[int]string, len(values)),
+		}
+		for s, i := range values {
+			e.values[s] = i
+			e.names[i] = s
+		}
+		if h.enums == nil {
+			h.enums = map[string]enumMapping{}
+		}
+		h.enums[field] = e
+	}
+}
+
+// WithTimestampFields stores the time.Time values of the given top level
+// fields as BSON timestamps, like those of the oplog, instead of dates. Values
+// are converted on Insert and Update and back by Find, and time comparands used
+// against the fields in predicates are converted as well. Timestamps only have
+// a precision of one second; their increment is set to 0 when storing a
+// time.Time, and dropped when reading them back. bson.MongoTimestamp values are
+// stored as is.
+func WithTimestampFields(fields []string) Option {
+	return func(h *Handler) {
+		h.timestamps = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			h.timestamps[f] = true
+		}
+	}
+}
+
+// WithFieldEncryption stores the given top level fields encrypted with enc.
+// Values are encrypted on Insert and Update and decrypted by Find. As the
+// database only sees ciphertexts, those fields can't be sorted on nor used
+// with comparison or regex predicates. Equality predicates ($eq, $ne, $in and
+// $nin) are supported only if enc is deterministic, i.e. always produces the
+// same ciphertext for a given value.
+func WithFieldEncryption(fields []string, enc Encrypter) Option {
+	return func(h *Handler) {
+		h.encrypted = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			h.encrypted[f] = true
+		}
+		h.encrypter = enc
+	}
+}
+
+// WithCurrentDate makes Update have the server set the _updated field to its
+// own current date, using $currentDate, instead of trusting the clock of the
+// application server. The date set by the server is read back into the
+// updated item.
+func WithCurrentDate() Option {
+	return func(h *Handler) {
+		h.currentDate = true
+	}
+}
+
+// WithVersionField makes Update, UpdateReturnOld and Delete use the integer
+// version stored in the name field, instead of the etag, to detect
+// concurrent writes: they fail with resource.ErrConflict unless the stored
+// version is the one of the original item. Update sets the version of the
+// updated item to the original version plus one, or to 1 if the original item
+// has no version. Insert stores the version as found in the items.
+func WithVersionField(name string) Option {
+	return func(h *Handler) {
+		h.versionField = name
+	}
+}
+
+// WithUpdatedPrecondition makes Update, UpdateReturnOld and Delete also check
+// that the stored update date of the item hasn't advanced past the one of the
+// original item, on top of its etag (or version), failing with
+// resource.ErrConflict otherwise. It guards against writers reusing etags.
+// Original items without update date are only checked by etag.
+func WithUpdatedPrecondition() Option {
+	return func(h *Handler) {
+		h.updatedPrecondition = true
+	}
+}
+
+// WithFieldOrder stores the top level fields of the items in a fixed order, for
+// the consumers of the documents depending on it: the _id, _etag and _updated
+// fields first, then the given fields in order, then the other fields sorted by
+// name. Without it, the order of the fields is unspecified. The order of the
+// fields of embedded documents is not affected, nor is the order of the fields
+// added to stored documents by updates using $set (see WithCurrentDate and
+// WithUpsert).
+func WithFieldOrder(fields []string) Option {
+	return func(h *Handler) {
+		h.fieldOrder = fields
+		if h.fieldOrder == nil {
+			h.fieldOrder = []string{}
+		}
+	}
+}
+
+// WithUpsert makes Update insert the item when it is not stored yet instead of
+// failing with resource.ErrNotFound.
+func WithUpsert() Option {
+	return func(h *Handler) {
+		h.upsert = true
+	}
+}
+
+// WithCreatedField sets the name of a field set to the item's update date when
+// Update inserts the item in upsert mode (using $setOnInsert), and left
+// untouched by subsequent updates. It has no effect without WithUpsert.
+func WithCreatedField(name string) Option {
+	return func(h *Handler) {
+		h.createdField = name
+	}
+}
+
+// WithPrefetch sets when the cursors of Find and FindEach request the next
+// batch of items, as the ratio p of the current batch left to consume (mgo
+// defaults to 0.25). A higher value reduces the waits of streaming consumers at
+// the cost of memory. p must be between 0 and 1.
+func WithPrefetch(p float64) Option {
+	return func(h *Handler) {
+		if p < 0 || p > 1 {
+			h.err = fmt.Errorf("invalid prefetch %v: must be between 0 and 1", p)
+			return
+		}
+		h.prefetch = &p
+	}
+}
+
+// WithCursorRetry makes Find and FindEach recover from their cursor being
+// killed by the server (CursorNotFound error), for instance when it timed out,
+// up to 3 times per query. Find runs its query again from the start while
+// FindEach resumes the iteration by skipping the items it already returned.
+// Unless the query is sorted on unique fields (the default sort on id is) and
+// no item matching it is inserted or removed meanwhile, FindEach may then
+// return some items twice or miss some.
+func WithCursorRetry() Option {
+	return func(h *Handler) {
+		h.cursorRetry = true
+	}
+}
+
+// WithNoCursorTimeout disables the timeout the server applies to idle cursors
+// (10 minutes by default) for the cursors of FindEach, so a callback slowly
+// processing items doesn't make the iteration fail. Such a cursor is only
+// released once fully iterated, when the callback returns an error or when the
+// context is done: a process dying while iterating leaves it orphaned on the
+// server, holding resources until it is killed manually.
+func WithNoCursorTimeout() Option {
+	return func(h *Handler) {
+		h.noCursorTimeout = true
+	}
+}
+
+// WithExactTotal makes Find always return the exact total number of items
+// matching the query when a window is requested, instead of -1 when it can't
+// be deduced from the returned page, like when the offset is beyond the last
+// matching item. The total is counted concurrently with the find, using the
+// same filter, so the latency is not doubled, at the cost of an extra query.
+func WithExactTotal() Option {
+	return func(h *Handler) {
+		h.exactTotal = true
+	}
+}
+
+// WithConsistentTotal makes Find compute the page of items and the exact total
+// number of items matching the query in a single aggregation, using a $facet
+// stage (MongoDB 3.4+), when a window is requested. Unlike with WithExactTotal,
+// whose count runs as a separate query, writes happening between the find and
+// the count can't make the total disagree with the page. As the page and the
+// total are returned by the server in a single document, pages can't exceed
+// the 16MB document size limit. It does not apply to handlers using computed
+// fields, a collation or WithMaxScan, nor to aggregate queries and to the
+// queries using the WithMatchedElement projection, which aggregations don't
+// support.
+func WithConsistentTotal() Option {
+	return func(h *Handler) {
+		h.consistentTotal = true
+	}
+}
+
+// WithUnorderedBulk makes Insert continue inserting the items following a
+// failing one instead of stopping at the first failure. All the valid items are
+// then inserted, and an *InsertError reports which items failed and why.
+func WithUnorderedBulk() Option {
+	return func(h *Handler) {
+		h.unorderedBulk = true
+	}
+}
+
+// WithShardKey declares the fields, other than id, of the shard key of a
+// sharded collection. Their values are added to the selectors of Update,
+// UpdateReturnOld, UpsertMany, ConditionalUpdate and Delete so those writes
+// are routed to the shard holding the item, as required for upserts, instead
+// of being broadcast to all shards.
+func WithShardKey(fields []string) Option {
+	return func(h *Handler) {
+		h.shardKey = fields
+	}
+}
+
+// WithPoolLimit limits to n the number of connections to each server the
+// session dialed by NewHandlerContext or NewHandlerDialer may open (mgo defaults
+// to 4096). Operations wait for a connection to be released once the limit is
+// reached. It has no effect on handlers created on top of an existing session,
+// whose limit is set with mgo.Session.SetPoolLimit. The maxPoolSize option of
+// the connection string is overridden when set.
+func WithPoolLimit(n int) Option {
+	return func(h *Handler) {
+		h.poolLimit = n
+	}
+}
+
+// WithUnwind flattens the given array fields, in order, before grouping in
+// aggregate queries and GroupCount, using $unwind stages: each element of the
+// arrays is then grouped as if it was a document on its own, so groups count
+// the occurrences of the elements. Documents missing the fields or having
+// empty arrays are left out. Fields are dot separated paths.
+func WithUnwind(fields ...string) Option {
+	return func(h *Handler) {
+		for _, f := range fields {
+			if err := validateFieldPath(f); err != nil {
+				h.err = err
+				return
+			}
+		}
+		h.unwind = fields
+	}
+}
+
+// WithTailAwaitTime sets the time the cursors of Tail wait for new items
+// before giving the handler an opportunity to check the context. It defaults to
+// one second.
+func WithTailAwaitTime(d time.Duration) Option {
+	return func(h *Handler) {
+		h.tailAwaitTime = d
+	}
+}
+
+// WithAllowDiskUse lets MongoDB write temporary files when running the
+// aggregation pipelines used by Find and GroupCount, so large groups or sorts
+// don't fail with ErrMemoryLimitExceeded.
+func WithAllowDiskUse() Option {
+	return func(h *Handler) {
+		h.allowDiskUse = true
+	}
+}
+
+// WithMutationHook sets a function called after items were successfully
+// written, for instance to invalidate an external cache, with the operation
+// (insert, update or delete) and the IDs of the written items. It is called by
+// Insert, including for the inserted items of a partially failed unordered
+// insert, Update, UpdateReturnOld, ConditionalUpdate when applied, and Delete,
+// but not for failed writes. Other writes, like Clear or UpsertMany, don't call
+// it. The hook is called synchronously and must be safe for concurrent use.
+func WithMutationHook(f func(op string, ids []interface{})) Option {
+	return func(h *Handler) {
+		h.mutationHook = f
+	}
+}
+
+// WithErrorMapper sets a function translating the errors returned by mgo
+// before the handler returns them, in place of DefaultErrorMapper. The mapper
+// is never called with a nil error and must return the errors it doesn't
+// handle unchanged, or pass them on to DefaultErrorMapper to keep the
+// ErrUnavailable mapping.
+func WithErrorMapper(f func(error) error) Option {
+	return func(h *Handler) {
+		h.errorMapper = f
+	}
+}
+
+// WithLogger sets a function receiving diagnostic logs, for instance when
+// dialing, acquiring and releasing sessions, running finds or retrying
+// upserts. level is one of debug, warn, for the recovered failures like the
+// cursor retries of WithCursorRetry, or error, and kv holds alternating keys
+// and values describing the event. Logs are discarded by default.
+func WithLogger(f func(level, msg string, kv ...interface{})) Option {
+	return func(h *Handler) {
+		h.logger = f
+	}
+}
+
+// WithStrictNull makes null equality predicates only match the fields
+// explicitly set to null: {f:null} matches the documents where f is null but
+// not those missing f, and {f:{$ne:null}} matches the documents missing f as
+// well as those where f is not null. Without it, MongoDB matches null and
+// missing fields alike. Missing fields alone are matched with {f:{$exists:false}}
+// in both cases.
+func WithStrictNull() Option {
+	return func(h *Handler) {
+		h.strictNull = true
+	}
+}
+
+// WithIntFields declares fields storing integers (int32 or int64 BSON values).
+// As numbers are parsed as float64 by rest-layer, integral comparands used
+// against those fields in predicates, like 1 in {age:1}, are converted to int
+// so they are sent with the stored type. Non integral comparands are left
+// unchanged.
+func WithIntFields(fields []string) Option {
+	return func(h *Handler) {
+		h.intFields = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			h.intFields[f] = true
+		}
+	}
+}
+
+// WithLooseBoolFields declares boolean fields for which legacy documents may
+// store 0 or 1 instead of false or true. Boolean comparands used against those
+// fields in predicates then match both representations.
+func WithLooseBoolFields(fields []string) Option {
+	return func(h *Handler) {
+		h.looseBool = make(map[string]bool, len(fields))
+		for _, f := range fields {
+			h.looseBool[f] = true
+		}
+	}
+}
+
+// WithTimePrecision sets the granularity the _updated field is truncated to
+// when stored. BSON dates have a millisecond precision which is thus the
+// default and the finest precision available; use a coarser value, like
+// time.Second, for systems only storing seconds.
+func WithTimePrecision(d time.Duration) Option {
+	return func(h *Handler) {
+		h.timePrecision = d
+	}
+}
+
+// WithDefaultTimeout sets a timeout of d to the operations performed with a
+// context having no deadline. Contexts with a deadline are left alone.
+func WithDefaultTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.defaultTimeout = d
+	}
+}
+
+// WithValidator has the predicates of the queries prepared against the
+// schema validator v before being translated, so that predicates the schema
+// doesn't allow, like a regex on a field which is not a filterable string, are
+// rejected before reaching the database.
+func WithValidator(v schema.Validator) Option {
+	return func(h *Handler) {
+		h.validator = v
+	}
+}
+
+// WithFieldProjection makes Find and FindEach only read the fields selected by
+// the query projection, along with the id, etag and updated date of the items.
+// Nested selections like address{city} only read the selected sub-fields. Use
+// WithValidator with it so the selections of the sub-fields of references,
+// which are not stored, read the whole reference field.
+//
+// rest-layer reads the item to patch or replace with the query of the request,
+// including its field selection, and stores the result of the patch: a PATCH
+// or PUT request selecting fields would then remove the fields it doesn't
+// select. Only use it for resources which are not written through rest-layer.
+func WithFieldProjection() Option {
+	return func(h *Handler) {
+		h.fieldProjection = true
+	}
+}
+
+// WithCoveredProjection makes Find and FindEach only read the fields listed in
+// the query projection, excluding _id unless the id field is listed, so a query
+// filtering, sorting and projecting on indexed fields only can be covered by an
+// index, without reading the documents. The items returned for such queries
+// then have a nil ID, an etag derived from it and no updated date: they can't be
+// used for updates or conditional requests. The WithSlice and WithMatchedElement
+// projections still apply.
+func WithCoveredProjection() Option {
+	return func(h *Handler) {
+		h.coveredProjection = true
+	}
+}
+
+// WithMatchedElement makes Find and FindEach only return the first element of
+// an array field matched by an $elemMatch predicate on that field, using a
+// positional projection. As such a projection excludes the fields which are not
+// explicitly included, items then only hold their id, the matched element and
+// the fields listed in the query projection.
+func WithMatchedElement() Option {
+	return func(h *Handler) {
+		h.matchedElement = true
+	}
+}
+
+// WithInternalFields allows queries to filter, sort or group on the fields
+// used by the handler to store the item metadata (etag, _etag and _updated),
+// and GroupCount, DistinctCount and Autocomplete to work on them, which are
+// otherwise rejected with an *InternalFieldError. Sorting by
+// last modification is always possible using the updated field.
+func WithInternalFields() Option {
+	return func(h *Handler) {
+		h.allowInternal = true
+	}
+}
+
+// WithDefaultSort sets the sort applied to queries having none, instead of
+// sorting by id. Fields are given in the query sort format: prefixed by a minus
+// for a descending order, with id referring to the item id and updated to its
+// update date. For instance, []string{"-updated", "id"} returns the most
+// recently updated items first.
+func WithDefaultSort(fields []string) Option {
+	return func(h *Handler) {
+		h.defaultSort = make([]string, len(fields))
+		for i, f := range fields {
+			if strings.HasPrefix(f, "-") {
+				h.defaultSort[i] = "-" + getSortField(f[1:])
+			} else {
+				h.defaultSort[i] = getSortField(f)
+			}
+		}
+	}
+}
+
+// WithComputedFields adds computed fields to the items returned by Find. The
+// fields map associates each computed field name with the aggregation
+// expression computing it, as accepted by an $addFields stage:
+//
+//	WithComputedFields(map[string]bson.M{
+//	    "fullName": {"$concat": []string{"$first", " ", "$last"}},
+//	})
+//
+// Find goes thru the aggregation framework when computed fields are
+// configured.
+func WithComputedFields(fields map[string]bson.M) Option {
+	return func(h *Handler) {
+		h.computed = make(bson.M, len(fields))
+		for f, exp := range fields {
+			h.computed[f] = exp
+		}
+	}
+}
+
+// WithCollation applies the collation c to Find and Count, so string
+// comparisons and sorts follow the rules of c. For instance, a collation with
+// a strength of 2 makes equality predicates case insensitive without having
+// to resort to a regex. Indexes are only used by queries specifying the same
+// collation.
+func WithCollation(c Collation) Option {
+	return func(h *Handler) {
+		h.collation = &c
+	}
+}
+
+// WithSlice limits the elements of the array field returned by Find using a
+// $slice projection. args is either the number of elements to return, from
+// the end of the array if negative, or the number of elements to skip
+// followed by the number of elements to return, which must be positive.
+func WithSlice(field string, args ...int) Option {
+	return func(h *Handler) {
+		if len(args) == 0 || len(args) > 2 {
+			h.err = fmt.Errorf("%s: invalid $slice: 1 or 2 arguments expected, got %d", field, len(args))
+			return
+		}
+		if len(args) == 2 && args[1] <= 0 {
+			h.err = fmt.Errorf("%s: invalid $slice: number of elements to return must be positive", field)
+			return
+		}
+		if h.slices == nil {
+			h.slices = map[string][]int{}
+		}
+		h.slices[field] = args
+	}
+}
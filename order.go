@@ -0,0 +1,42 @@
+package mongo
+
+import (
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// plainMongoItem has the fields of mongoItem without its bson.Getter.
+type plainMongoItem mongoItem
+
+// GetBSON implements bson.Getter to store the fields of the item in the order
+// set with WithFieldOrder, if any.
+func (i mongoItem) GetBSON() (interface{}, error) {
+	if i.order == nil {
+		return plainMongoItem(i), nil
+	}
+	d := make(bson.D, 0, len(i.Payload)+3)
+	d = append(d,
+		bson.DocElem{Name: "_id", Value: i.ID},
+		bson.DocElem{Name: "_etag", Value: i.ETag},
+		bson.DocElem{Name: "_updated", Value: i.Updated},
+	)
+	done := make(map[string]bool, len(i.order))
+	for _, f := range i.order {
+		if v, found := i.Payload[f]; found && !done[f] {
+			d = append(d, bson.DocElem{Name: f, Value: v})
+			done[f] = true
+		}
+	}
+	rest := make([]string, 0, len(i.Payload)-len(done))
+	for f := range i.Payload {
+		if !done[f] {
+			rest = append(rest, f)
+		}
+	}
+	sort.Strings(rest)
+	for _, f := range rest {
+		d = append(d, bson.DocElem{Name: f, Value: i.Payload[f]})
+	}
+	return d, nil
+}
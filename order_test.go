@@ -0,0 +1,84 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fieldNames returns the names of the fields of d, in order.
+func fieldNames(d bson.D) []string {
+	names := make([]string, len(d))
+	for i, e := range d {
+		names[i] = e.Name
+	}
+	return names
+}
+
+func TestFieldOrder(t *testing.T) {
+	item := &resource.Item{ID: "1", ETag: "a", Updated: time.Now(), Payload: map[string]interface{}{
+		"id": "1", "d": 4, "b": 2, "type": "x", "a": 1, "c": 3,
+	}}
+	h := NewHandler(&mgo.Session{}, "db", "test", WithFieldOrder([]string{"type", "c", "missing"}))
+	mItem, err := h.toMongoItem(item)
+	require.NoError(t, err)
+	b, err := bson.Marshal(mItem)
+	require.NoError(t, err)
+	var d bson.D
+	require.NoError(t, bson.Unmarshal(b, &d))
+	assert.Equal(t, []string{"_id", "_etag", "_updated", "type", "c", "a", "b", "d"}, fieldNames(d))
+
+	// Reads still produce a map
+	var back mongoItem
+	require.NoError(t, bson.Unmarshal(b, &back))
+	got, err := h.toItem(&back)
+	require.NoError(t, err)
+	assert.Equal(t, item.Payload, got.Payload)
+
+	// The marshaling of items is left alone without the option
+	mItem, err = NewHandler(&mgo.Session{}, "db", "test").toMongoItem(item)
+	require.NoError(t, err)
+	b, err = bson.Marshal(mItem)
+	require.NoError(t, err)
+	require.NoError(t, bson.Unmarshal(b, &back))
+	assert.Equal(t, "1", back.ID)
+	assert.Equal(t, map[string]interface{}{"d": 4, "b": 2, "type": "x", "a": 1, "c": 3}, back.Payload)
+}
+
+func TestFieldOrderStorage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testfieldorder")()
+	h := NewHandler(s, "testfieldorder", "test", WithFieldOrder([]string{"type"}))
+	ctx := context.Background()
+	item := &resource.Item{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "b": 2, "type": "x", "a": 1}}
+	require.NoError(t, h.Insert(ctx, []*resource.Item{item}))
+
+	c := s.DB("testfieldorder").C("test")
+	var d bson.D
+	require.NoError(t, c.FindId("1").One(&d))
+	assert.Equal(t, []string{"_id", "_etag", "_updated", "type", "a", "b"}, fieldNames(d))
+
+	updated := &resource.Item{ID: "1", ETag: "b", Payload: map[string]interface{}{"id": "1", "c": 3, "type": "y"}}
+	require.NoError(t, h.Update(ctx, updated, item))
+	d = nil
+	require.NoError(t, c.FindId("1").One(&d))
+	assert.Equal(t, []string{"_id", "_etag", "_updated", "type", "c"}, fieldNames(d))
+
+	l, err := h.Find(ctx, &query.Query{})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, map[string]interface{}{"id": "1", "c": 3, "type": "y"}, l.Items[0].Payload)
+}
@@ -1,7 +1,12 @@
 package mongo
 
 import (
+	"fmt"
+	"math"
+	"strings"
+
 	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema"
 	"github.com/oktacode/rest-layer/schema/query"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -10,6 +15,9 @@ import (
 // getField translate a schema field into a MongoDB field:
 //
 //  - id -> _id with in order to tape on the mongo primary key
+//
+// Other fields, including dotted paths with positional array segments like
+// items.0.status, are passed through as is.
 func getField(f string) string {
 	if f == "id" {
 		return "_id"
@@ -17,28 +25,140 @@ func getField(f string) string {
 	return f
 }
 
+// getSortField translate a schema field used in a sort into a MongoDB field.
+// On top of getField, the updated field is mapped to the _updated date of the
+// item, so items can be sorted by last modification.
+func getSortField(f string) string {
+	if f == "updated" {
+		return "_updated"
+	}
+	return getField(f)
+}
+
+// translator transforms rest-layer queries into Mongo queries according to
+// the handler settings.
+type translator struct {
+	// objectID converts hex string comparands of the id field to bson.ObjectId.
+	objectID bool
+	// objectIDFields lists the reference fields storing bson.ObjectId values.
+	objectIDFields map[string]bool
+	// encrypted lists the fields stored encrypted with encrypter.
+	encrypted map[string]bool
+	encrypter Encrypter
+	// intFields lists the fields storing integers, whose integral float
+	// comparands are converted to int.
+	intFields map[string]bool
+	// looseBool lists the boolean fields which may be stored as 0 or 1.
+	looseBool map[string]bool
+	// enums maps the string values of enum fields to their stored integer.
+	enums map[string]enumMapping
+	// defaultSort is the Mongo sort list used by queries without sort.
+	defaultSort []string
+	// slices holds the $slice projection arguments of array fields.
+	slices map[string][]int
+	// timestamps holds the fields stored as BSON timestamps.
+	timestamps map[string]bool
+	// idEncode and idDecode convert ids to and from their stored
+	// representation when set.
+	idEncode func(string) (interface{}, error)
+	idDecode func(interface{}) (string, error)
+	// strictNull makes null comparands only match explicit null values.
+	strictNull bool
+	// matchedElement projects the array element matched by $elemMatch.
+	matchedElement bool
+	// fieldProjection only reads the fields of the query projection, along
+	// with the item metadata.
+	fieldProjection bool
+	// coveredProjection only reads the fields of the query projection.
+	coveredProjection bool
+	// allowInternal allows queries on the internal fields.
+	allowInternal bool
+	// validator, when set, is used to check predicates before translation.
+	validator schema.Validator
+}
+
 // getQuery transform a query into a Mongo query.
-func getQuery(q *query.Query) (bson.M, error) {
-	return translatePredicate(q.Predicate)
+func (t translator) getQuery(q *query.Query) (bson.M, error) {
+	if t.validator != nil {
+		if err := q.Predicate.Prepare(t.validator); err != nil {
+			return nil, err
+		}
+	}
+	qry, err := t.translatePredicate(q.Predicate)
+	if err != nil {
+		return nil, err
+	}
+	if !t.allowInternal {
+		if err := checkInternalFields(qry); err != nil {
+			return nil, err
+		}
+		for _, s := range q.Sort {
+			if internalFields[s.Name] {
+				return nil, &InternalFieldError{Field: s.Name}
+			}
+		}
+	}
+	return qry, nil
+}
+
+// getGroupField returns the Mongo field for field when grouping or listing
+// its distinct values.
+func (t translator) getGroupField(field string) (string, error) {
+	if !t.allowInternal && internalFields[field] {
+		return "", &InternalFieldError{Field: field}
+	}
+	return t.translateField(field)
 }
 
 // getQuery transform a query into a Mongo query.
-func getAggregateQuery(q *query.Query) (bson.M, error) {
-	return translateAggregate(q.Aggregate)
+func (t translator) getAggregateQuery(q *query.Query) (bson.M, error) {
+	if !t.allowInternal {
+		for _, exp := range q.Aggregate {
+			if g, ok := exp.(*query.Group); ok && internalFields[g.Field] {
+				return nil, &InternalFieldError{Field: g.Field}
+			}
+		}
+	}
+	return t.translateAggregate(q.Aggregate)
+}
+
+// internalFields lists the fields used by the handler to store the item
+// metadata, which can't be queried unless WithInternalFields is set.
+var internalFields = map[string]bool{"etag": true, "_etag": true, "_updated": true}
+
+// checkInternalFields returns an *InternalFieldError if the Mongo query q
+// references an internal field.
+func checkInternalFields(q bson.M) error {
+	for k, v := range q {
+		if internalFields[k] {
+			return &InternalFieldError{Field: k}
+		}
+		if subs, ok := v.([]bson.M); ok && strings.HasPrefix(k, "$") {
+			for _, sub := range subs {
+				if err := checkInternalFields(sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // getSort transform a resource.Lookup into a Mongo sort list.
-// If the sort list is empty, fallback to _id.
-func getSort(q *query.Query) []string {
+// If the sort list is empty, fallback to the default sort or _id.
+func (t translator) getSort(q *query.Query) []string {
 	if len(q.Sort) == 0 {
+		if len(t.defaultSort) > 0 {
+			return t.defaultSort
+		}
 		return []string{"_id"}
 	}
 	s := make([]string, len(q.Sort))
 	for i, sort := range q.Sort {
 		if sort.Reversed {
-			s[i] = "-" + getField(sort.Name)
+			s[i] = "-" + getSortField(sort.Name)
 		} else {
-			s[i] = getField(sort.Name)
+			s[i] = getSortField(sort.Name)
 		}
 	}
 	return s
@@ -54,6 +174,169 @@ func applyWindow(mq *mgo.Query, w query.Window) *mgo.Query {
 	return mq
 }
 
+// getProjection returns the Mongo projection to apply to the documents found
+// by q, or nil if documents must be returned whole. When the field or covered
+// projection is enabled and q has a projection, only the selected fields are
+// read, along with the _id, _etag and _updated meta fields unless the
+// projection is covered.
+func (t translator) getProjection(q *query.Query) bson.M {
+	p := t.getFieldProjection(q)
+	if p == nil {
+		p = bson.M{}
+	}
+	for f, args := range t.slices {
+		if len(args) == 1 {
+			p[getField(f)] = bson.M{"$slice": args[0]}
+		} else {
+			p[getField(f)] = bson.M{"$slice": args}
+		}
+	}
+	if t.matchedElement {
+		for _, exp := range q.Predicate {
+			e, ok := exp.(*query.ElemMatch)
+			if !ok {
+				continue
+			}
+			// The positional projection only returns the included fields.
+			if len(q.Projection) > 0 && !selectsAll(q.Projection) {
+				for _, pf := range t.projectionFields("", q.Projection, nil) {
+					p[pf] = 1
+				}
+			}
+			// Paths within the array field would collide with it.
+			f := getField(e.Field)
+			for pf := range p {
+				if pf == f || strings.HasPrefix(pf, f+".") {
+					delete(p, pf)
+				}
+			}
+			p[f+".$"] = 1
+			p["_etag"] = 1
+			p["_updated"] = 1
+			break
+		}
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+// getFieldProjection returns the inclusion projection of the fields selected
+// by the projection of q, or nil if q selects all the fields or neither the
+// field nor the covered projection is enabled. Unlike getProjection, it can be
+// used in a $project aggregation stage.
+func (t translator) getFieldProjection(q *query.Query) bson.M {
+	if !t.fieldProjection && !t.coveredProjection {
+		return nil
+	}
+	if len(q.Projection) == 0 || selectsAll(q.Projection) {
+		return nil
+	}
+	p := bson.M{}
+	for _, f := range t.projectionFields("", q.Projection, nil) {
+		p[f] = 1
+	}
+	if t.coveredProjection {
+		// Leave _id out unless projected so an index can cover the query
+		if _, ok := p["_id"]; !ok {
+			p["_id"] = 0
+		}
+	} else {
+		p["_etag"] = 1
+		p["_updated"] = 1
+	}
+	return p
+}
+
+// selectsAll tells if the projection p selects all the fields with *.
+func selectsAll(p query.Projection) bool {
+	for _, pf := range p {
+		if pf.Name == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// projectionFields appends to fields the Mongo fields selected by the
+// projection p, whose fields are nested under prefix. Nested selections, like
+// address{city}, select the dotted paths of their sub-fields, like
+// address.city, instead of the whole parent field. The selections of all the
+// sub-fields with *, and those of references known to the validator, whose
+// sub-fields are not stored, select the whole field.
+func (t translator) projectionFields(prefix string, p query.Projection, fields []string) []string {
+	for _, pf := range p {
+		switch {
+		case len(pf.Children) > 0 && !selectsAll(pf.Children) && !t.isReference(prefix+pf.Name):
+			fields = t.projectionFields(prefix+pf.Name+".", pf.Children, fields)
+		case prefix == "":
+			fields = append(fields, getField(pf.Name))
+		default:
+			fields = append(fields, prefix+pf.Name)
+		}
+	}
+	return fields
+}
+
+// isReference tells if the validator defines field as a reference.
+func (t translator) isReference(field string) bool {
+	if t.validator == nil {
+		return false
+	}
+	f := t.validator.GetField(field)
+	if f == nil {
+		return false
+	}
+	switch f.Validator.(type) {
+	case *schema.Reference, schema.Reference:
+		return true
+	}
+	return false
+}
+
+// getSliceExpressions returns the aggregation expressions equivalent to the
+// $slice projections, to be used in an $addFields stage.
+func (t translator) getSliceExpressions() bson.M {
+	e := bson.M{}
+	for f, args := range t.slices {
+		f = getField(f)
+		s := []interface{}{"$" + f}
+		for _, a := range args {
+			s = append(s, a)
+		}
+		e[f] = bson.M{"$slice": s}
+	}
+	return e
+}
+
+// getSortStage transforms a Mongo sort list into a $sort pipeline stage.
+func getSortStage(srt []string) bson.D {
+	d := make(bson.D, len(srt))
+	for i, f := range srt {
+		if strings.HasPrefix(f, "-") {
+			d[i] = bson.DocElem{Name: f[1:], Value: -1}
+		} else {
+			d[i] = bson.DocElem{Name: f, Value: 1}
+		}
+	}
+	return d
+}
+
+// applyPipelineWindow appends the stages needed to apply w to the results of
+// an aggregation pipeline. Results are sorted according to the srt Mongo sort
+// list first so pages are stable from one request to the next.
+func applyPipelineWindow(pipeline []bson.M, srt []string, w query.Window) []bson.M {
+	pipeline = append(pipeline, bson.M{"$sort": getSortStage(srt)})
+	if w.Offset > 0 {
+		pipeline = append(pipeline, bson.M{"$skip": w.Offset})
+	}
+	if w.Limit > -1 {
+		pipeline = append(pipeline, bson.M{"$limit": w.Limit})
+	}
+	return pipeline
+}
+
 func selectIDs(c *mgo.Collection, mq *mgo.Query) ([]interface{}, error) {
 	var ids []interface{}
 	tmp := struct {
@@ -69,37 +352,213 @@ func selectIDs(c *mgo.Collection, mq *mgo.Query) ([]interface{}, error) {
 	return ids, nil
 }
 
-func translateAggregate(q query.Aggregate) (bson.M, error) {
+func (t translator) translateAggregate(q query.Aggregate) (bson.M, error) {
 	b := bson.M{}
 	for _, exp := range q {
-		switch t := exp.(type) {
+		switch e := exp.(type) {
 		case *query.Group:
-			b = bson.M{"_id": "$" + getField(t.Field), "total": bson.M{"$sum": 1}}
+			b = bson.M{"_id": "$" + getField(e.Field), "total": bson.M{"$sum": 1}}
 		default:
-			return nil, resource.ErrNotImplemented
+			return nil, notImplemented(exp)
 		}
 	}
 	return b, nil
 }
 
-func translatePredicate(q query.Predicate) (bson.M, error) {
+// Comment is a predicate expression annotating the query with a $comment,
+// passed thru to MongoDB and shown in its logs and profiler output. As the
+// query parser doesn't accept $comment, it is to be appended to a parsed
+// predicate by the tooling annotating the queries:
+//
+//	q.Predicate = append(q.Predicate, mongo.Comment("report #42"))
+//
+// It matches all the items.
+type Comment string
+
+// Match implements query.Expression.
+func (Comment) Match(payload map[string]interface{}) bool {
+	return true
+}
+
+// Prepare implements query.Expression.
+func (Comment) Prepare(validator schema.Validator) error {
+	return nil
+}
+
+// String implements query.Expression.
+func (c Comment) String() string {
+	return fmt.Sprintf("{$comment: %q}", string(c))
+}
+
+// notImplemented returns an error naming the unsupported query expression e,
+// which still matches resource.ErrNotImplemented using errors.Is.
+func notImplemented(e interface{}) error {
+	if s, ok := e.(fmt.Stringer); ok && s.String() != "" {
+		return fmt.Errorf("unsupported expression %T %s: %w", e, s, resource.ErrNotImplemented)
+	}
+	return fmt.Errorf("unsupported expression %T: %w", e, resource.ErrNotImplemented)
+}
+
+// rangeOperators lists the operators collapseRange may merge.
+var rangeOperators = map[string]bool{"$gt": true, "$gte": true, "$lt": true, "$lte": true}
+
+// collapseRange merges the clauses of an $and made of range operators on a
+// single field, like [{f:{$gte:1}},{f:{$lte:10}}], into one {$gte:1,$lte:10}
+// clause for the field f. The clauses are not merged if they target
+// different fields, use other operators or repeat an operator.
+func collapseRange(clauses []bson.M) (field string, r bson.M, ok bool) {
+	if len(clauses) < 2 {
+		return "", nil, false
+	}
+	r = bson.M{}
+	for _, c := range clauses {
+		if len(c) != 1 {
+			return "", nil, false
+		}
+		for f, v := range c {
+			ops, isOps := v.(bson.M)
+			if !isOps || (field != "" && f != field) {
+				return "", nil, false
+			}
+			field = f
+			for op, arg := range ops {
+				if _, dup := r[op]; dup || !rangeOperators[op] {
+					return "", nil, false
+				}
+				r[op] = arg
+			}
+		}
+	}
+	return field, r, true
+}
+
+// translateValue converts a predicate comparand for the given Mongo field.
+func (t translator) translateValue(field string, v interface{}) (interface{}, error) {
+	v = t.translateInt(field, v)
+	if id, ok, err := t.translateID(field, v); ok {
+		return id, err
+	}
+	if _, found := t.enums[field]; found && v != nil {
+		return t.encodeEnum(field, v)
+	}
+	if t.timestamps[field] && v != nil {
+		return t.encodeTimestamp(field, v)
+	}
+	if t.encrypted[field] {
+		// Only works with a deterministic encryption
+		return t.encrypt(v)
+	}
+	return v, nil
+}
+
+// translateID converts the comparand v of the id field, or of a field declared
+// with WithObjectIDFields, to its stored form using the id codec or object id
+// settings. ok is false when v is not converted.
+func (t translator) translateID(field string, v interface{}) (id interface{}, ok bool, err error) {
+	if field == "_id" && t.idEncode != nil && v != nil {
+		id, err = t.encodeID(v)
+		return id, true, err
+	}
+	if (t.objectID && field == "_id") || t.objectIDFields[field] {
+		if s, isString := v.(string); isString {
+			if !bson.IsObjectIdHex(s) {
+				return nil, true, fmt.Errorf("invalid object id: %q", s)
+			}
+			return bson.ObjectIdHex(s), true, nil
+		}
+	}
+	return v, false, nil
+}
+
+// translateField returns the Mongo field for a predicate using an operator
+// other than equality, which can't be applied to encrypted fields.
+func (t translator) translateField(f string) (string, error) {
+	if t.encrypted[f] {
+		return "", fmt.Errorf("%s: encrypted field can only be matched by equality", f)
+	}
+	return getField(f), nil
+}
+
+// bsonNull is the BSON type number of null values, for $type.
+const bsonNull = 10
+
+// translateRangeValue converts the comparand v of a range predicate for the
+// given Mongo field.
+func (t translator) translateRangeValue(field string, v interface{}) (interface{}, error) {
+	v = t.translateInt(field, v)
+	if id, ok, err := t.translateID(field, v); ok {
+		return id, err
+	}
+	if t.timestamps[field] {
+		return t.encodeTimestamp(field, v)
+	}
+	return v, nil
+}
+
+// translateInt converts v to an int when it is an integral float64 comparand
+// of a field declared with WithIntFields. Other values, like 1.5, are left
+// unchanged as converting them would change the meaning of range predicates.
+func (t translator) translateInt(field string, v interface{}) interface{} {
+	f, ok := v.(float64)
+	if !ok || !t.intFields[field] || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return v
+	}
+	return int(f)
+}
+
+// translateValues converts a list of predicate comparands for the given Mongo
+// field.
+func (t translator) translateValues(field string, vs []query.Value) ([]interface{}, error) {
+	s := make([]interface{}, 0, len(vs))
+	for _, v := range vs {
+		if lv, ok := t.looseBoolValues(field, v); ok {
+			s = append(s, lv...)
+			continue
+		}
+		tv, err := t.translateValue(field, v)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, tv)
+	}
+	return s, nil
+}
+
+// looseBoolValues returns all the stored forms of v when v is a boolean
+// comparand for a field configured with WithLooseBoolFields.
+func (t translator) looseBoolValues(field string, v interface{}) ([]interface{}, bool) {
+	b, ok := v.(bool)
+	if !ok || !t.looseBool[field] {
+		return nil, false
+	}
+	if b {
+		return []interface{}{true, 1}, true
+	}
+	return []interface{}{false, 0}, true
+}
+
+func (t translator) translatePredicate(q query.Predicate) (bson.M, error) {
 	b := bson.M{}
 	for _, exp := range q {
-		switch t := exp.(type) {
+		switch e := exp.(type) {
 		case *query.And:
 			s := []bson.M{}
-			for _, subExp := range *t {
-				sb, err := translatePredicate(query.Predicate{subExp})
+			for _, subExp := range *e {
+				sb, err := t.translatePredicate(query.Predicate{subExp})
 				if err != nil {
 					return nil, err
 				}
 				s = append(s, sb)
 			}
+			if f, r, ok := collapseRange(s); ok && b[f] == nil {
+				b[f] = r
+				continue
+			}
 			b["$and"] = s
 		case *query.Or:
 			s := []bson.M{}
-			for _, subExp := range *t {
-				sb, err := translatePredicate(query.Predicate{subExp})
+			for _, subExp := range *e {
+				sb, err := t.translatePredicate(query.Predicate{subExp})
 				if err != nil {
 					return nil, err
 				}
@@ -107,29 +566,132 @@ func translatePredicate(q query.Predicate) (bson.M, error) {
 			}
 			b["$or"] = s
 		case *query.In:
-			b[getField(t.Field)] = bson.M{"$in": t.Values}
+			// Against an array field, $in matches the documents whose array
+			// contains at least one of the values.
+			f := getField(e.Field)
+			v, err := t.translateValues(f, e.Values)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$in": v}
 		case *query.NotIn:
-			b[getField(t.Field)] = bson.M{"$nin": t.Values}
+			// Like $in, the id field is mapped to _id and each value is
+			// converted as a comparand of the field.
+			f := getField(e.Field)
+			v, err := t.translateValues(f, e.Values)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$nin": v}
 		case *query.Exist:
-			b[getField(t.Field)] = bson.M{"$exists": true}
+			b[getField(e.Field)] = bson.M{"$exists": true}
 		case *query.NotExist:
-			b[getField(t.Field)] = bson.M{"$exists": false}
+			b[getField(e.Field)] = bson.M{"$exists": false}
 		case *query.Equal:
-			b[getField(t.Field)] = t.Value
+			f := getField(e.Field)
+			if e.Value == nil && t.strictNull {
+				b[f] = bson.M{"$type": bsonNull}
+				continue
+			}
+			if lv, ok := t.looseBoolValues(f, e.Value); ok {
+				b[f] = bson.M{"$in": lv}
+				continue
+			}
+			v, err := t.translateValue(f, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			// An object comparand is passed as is, matching the embedded
+			// documents equal to it, extra fields and field order included.
+			b[f] = v
 		case *query.NotEqual:
-			b[getField(t.Field)] = bson.M{"$ne": t.Value}
+			// Against an array field, $ne matches the documents whose array
+			// doesn't contain the value at all, not those having at least one
+			// element different from it.
+			f := getField(e.Field)
+			if e.Value == nil && t.strictNull {
+				b[f] = bson.M{"$not": bson.M{"$type": bsonNull}}
+				continue
+			}
+			if lv, ok := t.looseBoolValues(f, e.Value); ok {
+				b[f] = bson.M{"$nin": lv}
+				continue
+			}
+			v, err := t.translateValue(f, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$ne": v}
 		case *query.GreaterThan:
-			b[getField(t.Field)] = bson.M{"$gt": t.Value}
+			f, err := t.translateField(e.Field)
+			if err != nil {
+				return nil, err
+			}
+			v, err := t.translateRangeValue(f, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$gt": v}
 		case *query.GreaterOrEqual:
-			b[getField(t.Field)] = bson.M{"$gte": t.Value}
+			f, err := t.translateField(e.Field)
+			if err != nil {
+				return nil, err
+			}
+			v, err := t.translateRangeValue(f, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$gte": v}
 		case *query.LowerThan:
-			b[getField(t.Field)] = bson.M{"$lt": t.Value}
+			f, err := t.translateField(e.Field)
+			if err != nil {
+				return nil, err
+			}
+			v, err := t.translateRangeValue(f, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$lt": v}
 		case *query.LowerOrEqual:
-			b[getField(t.Field)] = bson.M{"$lte": t.Value}
+			f, err := t.translateField(e.Field)
+			if err != nil {
+				return nil, err
+			}
+			v, err := t.translateRangeValue(f, e.Value)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$lte": v}
 		case *query.Regex:
-			b[getField(t.Field)] = bson.M{"$regex": t.Value.String()}
+			f, err := t.translateField(e.Field)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$regex": e.Value.String()}
+		case Comment:
+			b["$comment"] = string(e)
+		case *BitTest:
+			if err := e.validate(); err != nil {
+				return nil, err
+			}
+			f, err := t.translateField(e.Field)
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{e.Op: e.Positions}
+		case *query.ElemMatch:
+			f, err := t.translateField(e.Field)
+			if err != nil {
+				return nil, err
+			}
+			// The sub-expressions apply to the fields of the array elements
+			sub, err := translator{}.translatePredicate(query.Predicate(e.Exps))
+			if err != nil {
+				return nil, err
+			}
+			b[f] = bson.M{"$elemMatch": sub}
 		default:
-			return nil, resource.ErrNotImplemented
+			return nil, notImplemented(exp)
 		}
 	}
 	return b, nil
@@ -1,6 +1,8 @@
 package mongo
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"testing"
 
@@ -8,6 +10,7 @@ import (
 	"github.com/oktacode/rest-layer/schema"
 	"github.com/oktacode/rest-layer/schema/query"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -36,7 +39,7 @@ func TestTranslateAggregate(t *testing.T) {
 	for i := range cases {
 		tc := cases[i]
 		t.Run(tc.aggregate, func(t *testing.T) {
-			got, err := translateAggregate(query.MustParseAggregate(tc.aggregate))
+			got, err := translator{}.translateAggregate(query.MustParseAggregate(tc.aggregate))
 			if !reflect.DeepEqual(err, tc.err) {
 				t.Errorf("translateAggregate error:\ngot:  %v\nwant: %v", err, tc.err)
 			}
@@ -55,23 +58,34 @@ func TestTranslatePredicate(t *testing.T) {
 	}{
 		{`{id:"foo"}`, nil, bson.M{"_id": "foo"}},
 		{`{f:"foo"}`, nil, bson.M{"f": "foo"}},
+		{`{address:{city:"NYC",zip:"10001"}}`, nil, bson.M{"address": map[string]interface{}{"city": "NYC", "zip": "10001"}}},
 		{`{f:{$ne:"foo"}}`, nil, bson.M{"f": bson.M{"$ne": "foo"}}},
 		{`{f:{$exists:true}}`, nil, bson.M{"f": bson.M{"$exists": true}}},
 		{`{f:{$exists:false}}`, nil, bson.M{"f": bson.M{"$exists": false}}},
+		{`{id:{$exists:true}}`, nil, bson.M{"_id": bson.M{"$exists": true}}},
+		{`{id:{$exists:false}}`, nil, bson.M{"_id": bson.M{"$exists": false}}},
 		{`{f:{$gt:1}}`, nil, bson.M{"f": bson.M{"$gt": float64(1)}}},
 		{`{f:{$gte:1}}`, nil, bson.M{"f": bson.M{"$gte": float64(1)}}},
 		{`{f:{$lt:1}}`, nil, bson.M{"f": bson.M{"$lt": float64(1)}}},
 		{`{f:{$lte:1}}`, nil, bson.M{"f": bson.M{"$lte": float64(1)}}},
 		{`{f:{$in:["foo","bar"]}}`, nil, bson.M{"f": bson.M{"$in": []interface{}{"foo", "bar"}}}},
 		{`{f:{$nin:["foo","bar"]}}`, nil, bson.M{"f": bson.M{"$nin": []interface{}{"foo", "bar"}}}},
+		{`{id:{$in:["1","2"]}}`, nil, bson.M{"_id": bson.M{"$in": []interface{}{"1", "2"}}}},
+		{`{id:{$nin:["1","2"]}}`, nil, bson.M{"_id": bson.M{"$nin": []interface{}{"1", "2"}}}},
+		{`{f:{$elemMatch:{a:"foo",b:{$gt:1}}}}`, nil, bson.M{"f": bson.M{"$elemMatch": bson.M{"a": "foo", "b": bson.M{"$gt": float64(1)}}}}},
 		{`{f:{$regex:"fo[o]{1}.+is.+some"}}`, nil, bson.M{"f": bson.M{"$regex": "fo[o]{1}.+is.+some"}}},
 		{`{$and:[{f:"foo"},{f:"bar"}]}`, nil, bson.M{"$and": []bson.M{bson.M{"f": "foo"}, bson.M{"f": "bar"}}}},
+		{`{$and:[{f:{$gte:1}},{f:{$lte:10}}]}`, nil, bson.M{"f": bson.M{"$gte": float64(1), "$lte": float64(10)}}},
+		{`{$and:[{f:{$gt:1}},{f:{$lt:10}},{g:"foo"}]}`, nil, bson.M{"$and": []bson.M{bson.M{"f": bson.M{"$gt": float64(1)}}, bson.M{"f": bson.M{"$lt": float64(10)}}, bson.M{"g": "foo"}}}},
+		{`{$and:[{f:{$gte:1}},{g:{$lte:10}}]}`, nil, bson.M{"$and": []bson.M{bson.M{"f": bson.M{"$gte": float64(1)}}, bson.M{"g": bson.M{"$lte": float64(10)}}}}},
+		{`{$and:[{f:{$gt:1}},{f:{$gt:5}}]}`, nil, bson.M{"$and": []bson.M{bson.M{"f": bson.M{"$gt": float64(1)}}, bson.M{"f": bson.M{"$gt": float64(5)}}}}},
+		{`{$and:[{f:{$gte:1}},{f:{$ne:5}}]}`, nil, bson.M{"$and": []bson.M{bson.M{"f": bson.M{"$gte": float64(1)}}, bson.M{"f": bson.M{"$ne": float64(5)}}}}},
 		{`{$or:[{f:"foo"},{f:"bar"}]}`, nil, bson.M{"$or": []bson.M{bson.M{"f": "foo"}, bson.M{"f": "bar"}}}},
 	}
 	for i := range cases {
 		tc := cases[i]
 		t.Run(tc.predicate, func(t *testing.T) {
-			got, err := translatePredicate(query.MustParsePredicate(tc.predicate))
+			got, err := translator{}.translatePredicate(query.MustParsePredicate(tc.predicate))
 			if !reflect.DeepEqual(err, tc.err) {
 				t.Errorf("translatePredicate error:\ngot:  %v\nwant: %v", err, tc.err)
 			}
@@ -82,26 +96,494 @@ func TestTranslatePredicate(t *testing.T) {
 	}
 }
 
+func TestTranslatePredicateNull(t *testing.T) {
+	cases := []struct {
+		predicate string
+		strict    bool
+		want      bson.M
+	}{
+		// Null or missing
+		{`{f:null}`, false, bson.M{"f": nil}},
+		{`{f:{$ne:null}}`, false, bson.M{"f": bson.M{"$ne": nil}}},
+		// Explicitly null only
+		{`{f:null}`, true, bson.M{"f": bson.M{"$type": 10}}},
+		{`{f:{$ne:null}}`, true, bson.M{"f": bson.M{"$not": bson.M{"$type": 10}}}},
+		// Missing only
+		{`{f:{$exists:false}}`, false, bson.M{"f": bson.M{"$exists": false}}},
+		{`{f:{$exists:false}}`, true, bson.M{"f": bson.M{"$exists": false}}},
+		// Other values are left alone
+		{`{f:"foo"}`, true, bson.M{"f": "foo"}},
+	}
+	for _, tc := range cases {
+		got, err := translator{strictNull: tc.strict}.translatePredicate(query.MustParsePredicate(tc.predicate))
+		assert.NoError(t, err, tc.predicate)
+		assert.Equal(t, tc.want, got, "%s (strict: %v)", tc.predicate, tc.strict)
+	}
+}
+
+func TestTranslatePredicateComment(t *testing.T) {
+	p := append(query.MustParsePredicate(`{f:"foo"}`), Comment("report #42"))
+	got, err := translator{}.translatePredicate(p)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"f": "foo", "$comment": "report #42"}, got)
+
+	// The comment is kept at the top level of the query
+	p = query.Predicate{&query.Or{query.MustParsePredicate(`{f:"foo"}`)[0], query.MustParsePredicate(`{f:"bar"}`)[0]}, Comment("or")}
+	got, err = translator{}.translatePredicate(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "or", got["$comment"])
+	assert.Equal(t, `{$comment: "or"}`, Comment("or").String())
+}
+
 func TestTranslatePredicateInvalid(t *testing.T) {
 	var err error
-	_, err = translatePredicate(query.Predicate{UnsupportedExpression{}})
-	assert.Equal(t, resource.ErrNotImplemented, err)
-	_, err = translatePredicate(query.Predicate{&query.And{UnsupportedExpression{}}})
-	assert.Equal(t, resource.ErrNotImplemented, err)
-	_, err = translatePredicate(query.Predicate{&query.Or{UnsupportedExpression{}}})
-	assert.Equal(t, resource.ErrNotImplemented, err)
+	_, err = translator{}.translatePredicate(query.Predicate{UnsupportedExpression{}})
+	assert.True(t, errors.Is(err, resource.ErrNotImplemented))
+	_, err = translator{}.translatePredicate(query.Predicate{&query.And{UnsupportedExpression{}}})
+	assert.True(t, errors.Is(err, resource.ErrNotImplemented))
+	_, err = translator{}.translatePredicate(query.Predicate{&query.Or{UnsupportedExpression{}}})
+	assert.True(t, errors.Is(err, resource.ErrNotImplemented))
+}
+
+// nearExpression is an expression the translator doesn't support.
+type nearExpression struct {
+	UnsupportedExpression
+}
+
+func (nearExpression) String() string {
+	return "{loc: {$near: [1, 2]}}"
+}
+
+func TestTranslatePredicateInvalidMessage(t *testing.T) {
+	_, err := translator{}.translatePredicate(query.Predicate{nearExpression{}})
+	assert.True(t, errors.Is(err, resource.ErrNotImplemented))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "$near")
+		assert.Contains(t, err.Error(), "loc")
+	}
+	_, err = translator{}.translatePredicate(query.Predicate{UnsupportedExpression{}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "UnsupportedExpression")
+	}
 }
 
 func TestGetSort(t *testing.T) {
 	var s []string
-	s = getSort(&query.Query{Sort: query.Sort{}})
+	s = translator{}.getSort(&query.Query{Sort: query.Sort{}})
 	assert.Equal(t, []string{"_id"}, s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "id"}}})
+	s = translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "id"}}})
 	assert.Equal(t, []string{"_id"}, s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "f"}}})
+	s = translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "f"}}})
 	assert.Equal(t, []string{"f"}, s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "f", Reversed: true}}})
+	s = translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "f", Reversed: true}}})
 	assert.Equal(t, []string{"-f"}, s)
-	s = getSort(&query.Query{Sort: query.Sort{{Name: "f"}, {Name: "f", Reversed: true}}})
+	s = translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "f"}, {Name: "f", Reversed: true}}})
 	assert.Equal(t, []string{"f", "-f"}, s)
 }
+
+func TestGetSortUpdated(t *testing.T) {
+	s := translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "updated", Reversed: true}}})
+	assert.Equal(t, []string{"-_updated"}, s)
+	s = translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "updated"}, {Name: "id"}}})
+	assert.Equal(t, []string{"_updated", "_id"}, s)
+}
+
+func TestGetQueryInternalFields(t *testing.T) {
+	tr := translator{}
+	for _, p := range []string{`{_etag:"a"}`, `{etag:"a"}`, `{_updated:{$gt:1}}`, `{$or:[{f:"a"},{_etag:"a"}]}`} {
+		_, err := tr.getQuery(&query.Query{Predicate: query.MustParsePredicate(p)})
+		assert.IsType(t, &InternalFieldError{}, err, p)
+	}
+	_, err := tr.getQuery(&query.Query{Sort: query.Sort{{Name: "_etag"}}})
+	assert.EqualError(t, err, "_etag: internal field can't be queried")
+	_, err = tr.getAggregateQuery(&query.Query{Aggregate: query.MustParseAggregate(`{_updated:{$group:true}}`)})
+	assert.IsType(t, &InternalFieldError{}, err)
+	// The public updated field remains sortable
+	_, err = tr.getQuery(&query.Query{Sort: query.Sort{{Name: "updated", Reversed: true}}})
+	assert.NoError(t, err)
+
+	h := NewHandler(&mgo.Session{}, "db", "test", WithInternalFields())
+	got, err := h.getQuery(&query.Query{Predicate: query.MustParsePredicate(`{_etag:"a"}`), Sort: query.Sort{{Name: "_etag"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_etag": "a"}, got)
+}
+
+func TestGroupInternalFields(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(&mgo.Session{}, "db", "test")
+	for _, f := range []string{"_etag", "etag", "_updated"} {
+		_, err := h.GroupCount(ctx, &query.Query{}, f)
+		assert.IsType(t, &InternalFieldError{}, err, f)
+		_, err = h.DistinctCount(ctx, &query.Query{}, f)
+		assert.IsType(t, &InternalFieldError{}, err, f)
+		_, err = h.Autocomplete(ctx, f, "a", 10)
+		assert.IsType(t, &InternalFieldError{}, err, f)
+	}
+	got, err := NewHandler(&mgo.Session{}, "db", "test", WithInternalFields()).getGroupField("_etag")
+	assert.NoError(t, err)
+	assert.Equal(t, "_etag", got)
+	got, err = h.getGroupField("id")
+	assert.NoError(t, err)
+	assert.Equal(t, "_id", got)
+}
+
+func TestGetSortDefault(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithDefaultSort([]string{"-_updated", "id"}))
+	assert.Equal(t, []string{"-_updated", "_id"}, h.getSort(&query.Query{}))
+	// An explicit sort takes precedence
+	assert.Equal(t, []string{"f"}, h.getSort(&query.Query{Sort: query.Sort{{Name: "f"}}}))
+	h = NewHandler(&mgo.Session{}, "db", "test", WithDefaultSort([]string{"-id"}))
+	assert.Equal(t, []string{"-_id"}, h.getSort(&query.Query{}))
+	h = NewHandler(&mgo.Session{}, "db", "test", WithDefaultSort([]string{"-updated"}))
+	assert.Equal(t, []string{"-_updated"}, h.getSort(&query.Query{}))
+}
+
+func TestGetQueryValidator(t *testing.T) {
+	sch := schema.Schema{Fields: schema.Fields{
+		"name":   {Filterable: true, Validator: &schema.String{}},
+		"secret": {Validator: &schema.String{}},
+	}}
+	h := NewHandler(&mgo.Session{}, "db", "test", WithValidator(sch))
+	got, err := h.getQuery(&query.Query{Predicate: query.MustParsePredicate(`{name:{$regex:"^jo"}}`)})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"name": bson.M{"$regex": "^jo"}}, got)
+
+	_, err = h.getQuery(&query.Query{Predicate: query.MustParsePredicate(`{secret:{$regex:"^s"}}`)})
+	assert.Error(t, err)
+	_, err = h.getQuery(&query.Query{Predicate: query.MustParsePredicate(`{$or:[{name:"jo"},{unknown:{$regex:"^s"}}]}`)})
+	assert.Error(t, err)
+}
+
+func TestTranslatePredicateObjectID(t *testing.T) {
+	const (
+		hex1 = "59a40602952dbd0001c3ffc9"
+		hex2 = "59a40602952dbd0001c3ffca"
+	)
+	oid1, oid2 := bson.ObjectIdHex(hex1), bson.ObjectIdHex(hex2)
+	cases := []struct {
+		predicate string
+		err       error
+		want      bson.M
+	}{
+		{`{id:"` + hex1 + `"}`, nil, bson.M{"_id": oid1}},
+		{`{id:{$ne:"` + hex1 + `"}}`, nil, bson.M{"_id": bson.M{"$ne": oid1}}},
+		{`{id:{$in:["` + hex1 + `","` + hex2 + `"]}}`, nil, bson.M{"_id": bson.M{"$in": []interface{}{oid1, oid2}}}},
+		{`{id:{$nin:["` + hex1 + `","` + hex2 + `"]}}`, nil, bson.M{"_id": bson.M{"$nin": []interface{}{oid1, oid2}}}},
+		{`{id:{$in:["` + hex1 + `","foo"]}}`, errors.New(`invalid object id: "foo"`), nil},
+		{`{id:{$nin:["bar"]}}`, errors.New(`invalid object id: "bar"`), nil},
+		{`{f:{$in:["foo"]}}`, nil, bson.M{"f": bson.M{"$in": []interface{}{"foo"}}}},
+		{`{id:{$exists:true}}`, nil, bson.M{"_id": bson.M{"$exists": true}}},
+	}
+	tr := translator{objectID: true}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			got, err := tr.translatePredicate(query.MustParsePredicate(tc.predicate))
+			if !reflect.DeepEqual(err, tc.err) {
+				t.Errorf("translatePredicate error:\ngot:  %v\nwant: %v", err, tc.err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslatePredicateObjectIDFields(t *testing.T) {
+	const hex = "59a40602952dbd0001c3ffc9"
+	oid := bson.ObjectIdHex(hex)
+	tr := translator{objectIDFields: map[string]bool{"parent": true}}
+	got, err := tr.translatePredicate(query.MustParsePredicate(`{parent:"` + hex + `"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"parent": oid}, got)
+	got, err = tr.translatePredicate(query.MustParsePredicate(`{parent:{$in:["` + hex + `"]}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"parent": bson.M{"$in": []interface{}{oid}}}, got)
+	// The id field is left untouched
+	got, err = tr.translatePredicate(query.MustParsePredicate(`{id:"` + hex + `"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": hex}, got)
+	_, err = tr.translatePredicate(query.MustParsePredicate(`{parent:"foo"}`))
+	assert.EqualError(t, err, `invalid object id: "foo"`)
+}
+
+func TestApplyPipelineWindow(t *testing.T) {
+	base := []bson.M{{"$match": bson.M{}}, {"$group": bson.M{"_id": "$f"}}}
+	cases := []struct {
+		name   string
+		window query.Window
+		want   []bson.M
+	}{
+		{"limit", query.Window{Limit: 2}, []bson.M{{"$sort": bson.D{{Name: "_id", Value: 1}}}, {"$limit": 2}}},
+		{"offset", query.Window{Limit: -1, Offset: 2}, []bson.M{{"$sort": bson.D{{Name: "_id", Value: 1}}}, {"$skip": 2}}},
+		{"both", query.Window{Limit: 2, Offset: 4}, []bson.M{{"$sort": bson.D{{Name: "_id", Value: 1}}}, {"$skip": 4}, {"$limit": 2}}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.name, func(t *testing.T) {
+			p := append([]bson.M{}, base...)
+			got := applyPipelineWindow(p, []string{"_id"}, tc.window)
+			assert.Equal(t, append(append([]bson.M{}, base...), tc.want...), got)
+		})
+	}
+}
+
+func TestTranslatePredicateLooseBool(t *testing.T) {
+	cases := []struct {
+		predicate string
+		want      bson.M
+	}{
+		{`{active:true}`, bson.M{"active": bson.M{"$in": []interface{}{true, 1}}}},
+		{`{active:false}`, bson.M{"active": bson.M{"$in": []interface{}{false, 0}}}},
+		{`{active:{$ne:true}}`, bson.M{"active": bson.M{"$nin": []interface{}{true, 1}}}},
+		{`{active:{$in:[false]}}`, bson.M{"active": bson.M{"$in": []interface{}{false, 0}}}},
+		{`{active:{$nin:[true]}}`, bson.M{"active": bson.M{"$nin": []interface{}{true, 1}}}},
+		{`{other:true}`, bson.M{"other": true}},
+	}
+	tr := translator{looseBool: map[string]bool{"active": true}}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			got, err := tr.translatePredicate(query.MustParsePredicate(tc.predicate))
+			if err != nil {
+				t.Errorf("translatePredicate unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslatePredicateIntFields(t *testing.T) {
+	cases := []struct {
+		predicate string
+		want      bson.M
+	}{
+		{`{age:1}`, bson.M{"age": 1}},
+		{`{age:{$ne:-3}}`, bson.M{"age": bson.M{"$ne": -3}}},
+		{`{age:{$in:[1,2]}}`, bson.M{"age": bson.M{"$in": []interface{}{1, 2}}}},
+		{`{age:{$gte:18}}`, bson.M{"age": bson.M{"$gte": 18}}},
+		{`{age:{$lt:1.5}}`, bson.M{"age": bson.M{"$lt": 1.5}}},
+		{`{age:"1"}`, bson.M{"age": "1"}},
+		{`{other:1}`, bson.M{"other": float64(1)}},
+	}
+	tr := translator{intFields: map[string]bool{"age": true}}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			got, err := tr.translatePredicate(query.MustParsePredicate(tc.predicate))
+			if err != nil {
+				t.Errorf("translatePredicate unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslatePredicatePositional(t *testing.T) {
+	cases := []struct {
+		predicate string
+		want      bson.M
+	}{
+		{`{items.0.status:"done"}`, bson.M{"items.0.status": "done"}},
+		{`{items.10.status:{$ne:"done"}}`, bson.M{"items.10.status": bson.M{"$ne": "done"}}},
+		{`{items.0:{$exists:true}}`, bson.M{"items.0": bson.M{"$exists": true}}},
+		{`{$or:[{items.0.n:{$gt:1}},{items.1.n:{$lt:1}}]}`, bson.M{"$or": []bson.M{
+			bson.M{"items.0.n": bson.M{"$gt": float64(1)}},
+			bson.M{"items.1.n": bson.M{"$lt": float64(1)}},
+		}}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			got, err := translator{}.translatePredicate(query.MustParsePredicate(tc.predicate))
+			if err != nil {
+				t.Errorf("translatePredicate unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTranslatePredicateMapKeys(t *testing.T) {
+	cases := []struct {
+		predicate string
+		want      bson.M
+	}{
+		{`{attrs.color:"red"}`, bson.M{"attrs.color": "red"}},
+		{`{attrs.Color_2:{$ne:"red"}}`, bson.M{"attrs.Color_2": bson.M{"$ne": "red"}}},
+		{`{attrs.size:{$gte:10}}`, bson.M{"attrs.size": bson.M{"$gte": float64(10)}}},
+		{`{attrs.color:{$exists:true}}`, bson.M{"attrs.color": bson.M{"$exists": true}}},
+		{`{attrs.color:{$in:["red","blue"]}}`, bson.M{"attrs.color": bson.M{"$in": []interface{}{"red", "blue"}}}},
+		{`{meta.attrs.id:"1"}`, bson.M{"meta.attrs.id": "1"}},
+	}
+	for i := range cases {
+		tc := cases[i]
+		t.Run(tc.predicate, func(t *testing.T) {
+			got, err := translator{}.translatePredicate(query.MustParsePredicate(tc.predicate))
+			if err != nil {
+				t.Errorf("translatePredicate unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("translatePredicate:\ngot:  %#v\nwant: %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetSortPositional(t *testing.T) {
+	s := translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "items.0.status"}}})
+	assert.Equal(t, []string{"items.0.status"}, s)
+	s = translator{}.getSort(&query.Query{Sort: query.Sort{{Name: "items.1.date", Reversed: true}, {Name: "id"}}})
+	assert.Equal(t, []string{"-items.1.date", "_id"}, s)
+}
+
+func TestGetProjectionMatchedElement(t *testing.T) {
+	q := &query.Query{
+		Predicate:  query.MustParsePredicate(`{comments:{$elemMatch:{author:"bob"}}}`),
+		Projection: query.Projection{{Name: "title"}, {Name: "comments"}},
+	}
+	assert.Nil(t, translator{}.getProjection(q))
+	assert.Equal(t, bson.M{"title": 1, "comments": 1, "_etag": 1, "_updated": 1}, translator{fieldProjection: true}.getProjection(q))
+	tr := translator{matchedElement: true}
+	assert.Equal(t, bson.M{"comments.$": 1, "_etag": 1, "_updated": 1, "title": 1}, tr.getProjection(q))
+	assert.Nil(t, tr.getProjection(&query.Query{Predicate: query.MustParsePredicate(`{title:"foo"}`)}))
+}
+
+func TestGetProjectionCovered(t *testing.T) {
+	q := &query.Query{Projection: query.Projection{{Name: "name"}, {Name: "age"}}}
+	assert.Nil(t, translator{}.getProjection(q))
+	assert.Equal(t, bson.M{"name": 1, "age": 1, "_etag": 1, "_updated": 1}, translator{fieldProjection: true}.getProjection(q))
+	tr := translator{coveredProjection: true}
+	assert.Equal(t, bson.M{"_id": 0, "name": 1, "age": 1}, tr.getProjection(q))
+	q.Projection = append(q.Projection, query.ProjectionField{Name: "id"})
+	assert.Equal(t, bson.M{"_id": 1, "name": 1, "age": 1}, tr.getProjection(q))
+	assert.Nil(t, tr.getProjection(&query.Query{}))
+}
+
+func TestGetProjectionNested(t *testing.T) {
+	q := &query.Query{
+		Predicate: query.MustParsePredicate(`{comments:{$elemMatch:{author:"bob"}}}`),
+		Projection: query.Projection{
+			{Name: "id"},
+			{Name: "address", Children: query.Projection{
+				{Name: "city"},
+				{Name: "geo", Children: query.Projection{{Name: "lat"}, {Name: "lng"}}},
+			}},
+			{Name: "owner", Children: query.Projection{{Name: "id"}}},
+			{Name: "comments", Children: query.Projection{{Name: "author"}}},
+		},
+	}
+	assert.Equal(t, []string{"_id", "address.city", "address.geo.lat", "address.geo.lng", "owner.id", "comments.author"},
+		translator{}.projectionFields("", q.Projection, nil))
+
+	tr := translator{matchedElement: true}
+	assert.Equal(t, bson.M{
+		"_id":             1,
+		"address.city":    1,
+		"address.geo.lat": 1,
+		"address.geo.lng": 1,
+		"owner.id":        1,
+		"comments.$":      1,
+		"_etag":           1,
+		"_updated":        1,
+	}, tr.getProjection(q))
+
+	tr = translator{coveredProjection: true}
+	assert.Equal(t, bson.M{
+		"_id":             1,
+		"address.city":    1,
+		"address.geo.lat": 1,
+		"address.geo.lng": 1,
+		"owner.id":        1,
+		"comments.author": 1,
+	}, tr.getProjection(q))
+}
+
+func TestGetProjectionField(t *testing.T) {
+	q := &query.Query{Projection: query.Projection{
+		{Name: "name"},
+		{Name: "address", Children: query.Projection{{Name: "city"}}},
+		{Name: "owner", Children: query.Projection{{Name: "name"}}},
+		{Name: "meta", Children: query.Projection{{Name: "*"}}},
+	}}
+	// Documents are read whole unless the field projection is enabled
+	assert.Nil(t, translator{}.getProjection(q))
+
+	tr := translator{fieldProjection: true}
+	assert.Nil(t, tr.getProjection(&query.Query{}))
+	assert.Equal(t, bson.M{
+		"name":         1,
+		"address.city": 1,
+		"owner.name":   1,
+		"meta":         1,
+		"_etag":        1,
+		"_updated":     1,
+	}, tr.getProjection(q))
+
+	// The sub-fields of references are not stored
+	tr.validator = schema.Schema{Fields: schema.Fields{
+		"owner": {Validator: &schema.Reference{Path: "users"}},
+	}}
+	assert.Equal(t, bson.M{
+		"name":         1,
+		"address.city": 1,
+		"owner":        1,
+		"meta":         1,
+		"_etag":        1,
+		"_updated":     1,
+	}, tr.getProjection(q))
+
+	// Selecting all the fields reads the whole documents
+	q.Projection = append(q.Projection, query.ProjectionField{Name: "*"})
+	assert.Nil(t, tr.getProjection(q))
+}
+
+func TestGetProjectionCoveredMerge(t *testing.T) {
+	q := &query.Query{
+		Predicate:  query.MustParsePredicate(`{comments:{$elemMatch:{author:"bob"}}}`),
+		Projection: query.Projection{{Name: "title"}, {Name: "comments", Children: query.Projection{{Name: "author"}}}},
+	}
+	tr := translator{coveredProjection: true, slices: map[string][]int{"tags": {5}}}
+	assert.Equal(t, bson.M{
+		"_id":             0,
+		"title":           1,
+		"comments.author": 1,
+		"tags":            bson.M{"$slice": 5},
+	}, tr.getProjection(q))
+
+	tr.matchedElement = true
+	assert.Equal(t, bson.M{
+		"_id":        0,
+		"title":      1,
+		"tags":       bson.M{"$slice": 5},
+		"comments.$": 1,
+		"_etag":      1,
+		"_updated":   1,
+	}, tr.getProjection(q))
+}
+
+func TestGetSortStage(t *testing.T) {
+	assert.Equal(t, bson.D{{Name: "_id", Value: 1}}, getSortStage([]string{"_id"}))
+	assert.Equal(t, bson.D{{Name: "name", Value: -1}, {Name: "_id", Value: 1}}, getSortStage([]string{"-name", "_id"}))
+}
+
+func TestGetProjectionSlice(t *testing.T) {
+	tr := translator{}
+	assert.Nil(t, tr.getProjection(&query.Query{}))
+
+	tr.slices = map[string][]int{"comments": {10}, "tags": {5, 2}}
+	assert.Equal(t, bson.M{
+		"comments": bson.M{"$slice": 10},
+		"tags":     bson.M{"$slice": []int{5, 2}},
+	}, tr.getProjection(&query.Query{}))
+	assert.Equal(t, bson.M{
+		"comments": bson.M{"$slice": []interface{}{"$comments", 10}},
+		"tags":     bson.M{"$slice": []interface{}{"$tags", 5, 2}},
+	}, tr.getSliceExpressions())
+}
@@ -0,0 +1,68 @@
+package mongo
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2"
+)
+
+// ServerInfo describes the version and capabilities of the MongoDB server of a
+// handler, as reported by the buildInfo command.
+type ServerInfo struct {
+	// Version is the server version, like "4.4.6".
+	Version string
+	// VersionArray holds the major, minor, patch and build numbers of the
+	// version.
+	VersionArray []int
+	// MaxDocumentSize is the maximum size of a BSON document, in bytes.
+	MaxDocumentSize int
+	// Collation tells if the server supports collations, used by
+	// WithCollation (MongoDB 3.4+).
+	Collation bool
+	// ChangeStreams tells if the server supports change streams, used by Watch
+	// (MongoDB 3.6+). They also require a replica set or a sharded cluster.
+	ChangeStreams bool
+	// Transactions tells if the server supports multi-document transactions
+	// (MongoDB 4.0+). They also require a replica set, or MongoDB 4.2+ for a
+	// sharded cluster.
+	Transactions bool
+}
+
+// AtLeast tells if the server version is greater than or equal to version,
+// given as major, minor… numbers.
+func (i ServerInfo) AtLeast(version ...int) bool {
+	bi := mgo.BuildInfo{VersionArray: i.VersionArray}
+	return bi.VersionAtLeast(version...)
+}
+
+// ServerInfo returns the version and capabilities of the server, for instance
+// to only use the features it supports.
+func (m Handler) ServerInfo(ctx context.Context) (ServerInfo, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	defer m.close(c)
+	bi, err := c.Database.Session.BuildInfo()
+	if ctx.Err() != nil {
+		return ServerInfo{}, ctx.Err()
+	}
+	if err != nil {
+		return ServerInfo{}, m.mapError(err)
+	}
+	return newServerInfo(bi), nil
+}
+
+// newServerInfo derives the server info from the reply of buildInfo.
+func newServerInfo(bi mgo.BuildInfo) ServerInfo {
+	return ServerInfo{
+		Version:         bi.Version,
+		VersionArray:    bi.VersionArray,
+		MaxDocumentSize: bi.MaxObjectSize,
+		Collation:       bi.VersionAtLeast(3, 4),
+		ChangeStreams:   bi.VersionAtLeast(3, 6),
+		Transactions:    bi.VersionAtLeast(4, 0),
+	}
+}
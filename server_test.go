@@ -0,0 +1,56 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+)
+
+func TestNewServerInfo(t *testing.T) {
+	cases := []struct {
+		version                                []int
+		collation, changeStreams, transactions bool
+	}{
+		{[]int{3, 2, 22, 0}, false, false, false},
+		{[]int{3, 4, 0, 0}, true, false, false},
+		{[]int{3, 6, 23, 0}, true, true, false},
+		{[]int{4, 0, 0, 0}, true, true, true},
+		{[]int{4, 4, 6, 0}, true, true, true},
+	}
+	for _, tc := range cases {
+		info := newServerInfo(mgo.BuildInfo{Version: "x", VersionArray: tc.version, MaxObjectSize: 16777216})
+		assert.Equal(t, "x", info.Version)
+		assert.Equal(t, tc.version, info.VersionArray)
+		assert.Equal(t, 16777216, info.MaxDocumentSize)
+		assert.Equal(t, tc.collation, info.Collation, "%v collation", tc.version)
+		assert.Equal(t, tc.changeStreams, info.ChangeStreams, "%v change streams", tc.version)
+		assert.Equal(t, tc.transactions, info.Transactions, "%v transactions", tc.version)
+	}
+
+	info := ServerInfo{VersionArray: []int{4, 2, 1, 0}}
+	assert.True(t, info.AtLeast(4))
+	assert.True(t, info.AtLeast(4, 2, 1))
+	assert.False(t, info.AtLeast(4, 4))
+	assert.False(t, info.AtLeast(5))
+}
+
+func TestServerInfo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := NewHandler(s, "testserverinfo", "test")
+	info, err := h.ServerInfo(context.Background())
+	if assert.NoError(t, err) {
+		assert.NotEmpty(t, info.Version)
+		if assert.Len(t, info.VersionArray, 4) {
+			assert.True(t, info.VersionArray[0] >= 2)
+		}
+		assert.True(t, info.MaxDocumentSize > 0)
+	}
+}
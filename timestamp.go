@@ -0,0 +1,66 @@
+package mongo
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// encodeTimestamp returns the BSON timestamp stored for the time.Time value v
+// of field. Stored timestamps are made of the seconds of v and an increment of
+// 0. bson.MongoTimestamp values are stored as is.
+func (t translator) encodeTimestamp(field string, v interface{}) (interface{}, error) {
+	switch ts := v.(type) {
+	case time.Time:
+		return bson.MongoTimestamp(ts.Unix() << 32), nil
+	case bson.MongoTimestamp:
+		return ts, nil
+	default:
+		return nil, fmt.Errorf("%s: invalid timestamp value type: %T", field, v)
+	}
+}
+
+// decodeTimestamp returns the time.Time of the BSON timestamp v stored for
+// field. The increment of the timestamp is dropped.
+func (t translator) decodeTimestamp(field string, v interface{}) (interface{}, error) {
+	ts, ok := v.(bson.MongoTimestamp)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid stored timestamp value type: %T", field, v)
+	}
+	return time.Unix(int64(ts)>>32, 0), nil
+}
+
+// encodeTimestampPayload replaces the time values of the timestamp fields of p
+// by BSON timestamps, in place.
+func (t translator) encodeTimestampPayload(p map[string]interface{}) error {
+	for f := range t.timestamps {
+		v, found := p[f]
+		if !found || v == nil {
+			continue
+		}
+		ev, err := t.encodeTimestamp(f, v)
+		if err != nil {
+			return err
+		}
+		p[f] = ev
+	}
+	return nil
+}
+
+// decodeTimestampPayload replaces the BSON timestamps of the timestamp fields
+// of p by their time value, in place.
+func (t translator) decodeTimestampPayload(p map[string]interface{}) error {
+	for f := range t.timestamps {
+		v, found := p[f]
+		if !found || v == nil {
+			continue
+		}
+		dv, err := t.decodeTimestamp(f, v)
+		if err != nil {
+			return err
+		}
+		p[f] = dv
+	}
+	return nil
+}
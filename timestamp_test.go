@@ -0,0 +1,86 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTimestampFieldsRoundTrip(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithTimestampFields([]string{"ts"}))
+	ts := time.Date(2018, 1, 1, 12, 30, 15, 0, time.UTC)
+	item := &resource.Item{
+		ID:      "1",
+		Payload: map[string]interface{}{"id": "1", "ts": ts},
+	}
+	mItem, err := h.toMongoItem(item)
+	require.NoError(t, err)
+	assert.Equal(t, bson.MongoTimestamp(ts.Unix()<<32), mItem.Payload["ts"])
+	// The original item must be left untouched
+	assert.Equal(t, ts, item.Payload["ts"])
+
+	// Read back as decoded by mgo
+	b, err := bson.Marshal(mItem)
+	require.NoError(t, err)
+	var raw bson.M
+	require.NoError(t, bson.Unmarshal(b, &raw))
+	assert.IsType(t, bson.MongoTimestamp(0), raw["ts"])
+	var back mongoItem
+	require.NoError(t, bson.Unmarshal(b, &back))
+	got, err := h.toItem(&back)
+	require.NoError(t, err)
+	assert.True(t, ts.Equal(got.Payload["ts"].(time.Time)))
+
+	_, err = h.toMongoItem(&resource.Item{ID: "2", Payload: map[string]interface{}{"ts": "now"}})
+	assert.EqualError(t, err, `ts: invalid timestamp value type: string`)
+	_, err = h.toItem(&mongoItem{ID: "2", Payload: map[string]interface{}{"ts": time.Now()}})
+	assert.EqualError(t, err, `ts: invalid stored timestamp value type: time.Time`)
+}
+
+func TestTimestampFieldsPredicate(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test", WithTimestampFields([]string{"ts"}))
+	ts := time.Date(2018, 1, 1, 12, 30, 15, 0, time.UTC)
+	got, err := h.translatePredicate(query.Predicate{&query.GreaterThan{Field: "ts", Value: ts}})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"ts": bson.M{"$gt": bson.MongoTimestamp(ts.Unix() << 32)}}, got)
+
+	got, err = h.translatePredicate(query.Predicate{&query.Equal{Field: "ts", Value: ts}})
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"ts": bson.MongoTimestamp(ts.Unix() << 32)}, got)
+}
+
+func TestTimestampFieldsStorage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testtimestampfields")()
+	h := NewHandler(s, "testtimestampfields", "test", WithTimestampFields([]string{"ts"}))
+	ctx := context.Background()
+	ts := time.Date(2018, 1, 1, 12, 30, 15, 0, time.UTC)
+	items := []*resource.Item{
+		{ID: "1", Payload: map[string]interface{}{"id": "1", "ts": ts}},
+		{ID: "2", Payload: map[string]interface{}{"id": "2", "ts": ts.Add(time.Hour)}},
+	}
+	require.NoError(t, h.Insert(ctx, items))
+
+	var d bson.M
+	require.NoError(t, s.DB("testtimestampfields").C("test").FindId("1").One(&d))
+	assert.Equal(t, bson.MongoTimestamp(ts.Unix()<<32), d["ts"])
+
+	l, err := h.Find(ctx, &query.Query{Predicate: query.Predicate{&query.GreaterThan{Field: "ts", Value: ts}}})
+	require.NoError(t, err)
+	require.Len(t, l.Items, 1)
+	assert.Equal(t, "2", l.Items[0].ID)
+	assert.True(t, ts.Add(time.Hour).Equal(l.Items[0].Payload["ts"].(time.Time)))
+}
@@ -0,0 +1,57 @@
+package mongo
+
+import (
+	"github.com/oktacode/rest-layer/schema/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Translator translates REST Layer queries into MongoDB queries the same way a
+// Handler does, for use with a MongoDB collection accessed directly.
+type Translator struct {
+	t translator
+}
+
+// NewTranslator creates a translator configured with the options affecting
+// the query translation, like WithObjectID, WithEnumMapping or
+// WithDefaultSort. Other options are ignored.
+func NewTranslator(opts ...Option) (Translator, error) {
+	var h Handler
+	for _, opt := range opts {
+		opt(&h)
+	}
+	if h.err != nil {
+		return Translator{}, h.err
+	}
+	return Translator{t: h.translator}, nil
+}
+
+// Translator returns the translator of the handler.
+func (m Handler) Translator() Translator {
+	return Translator{t: m.translator}
+}
+
+// Predicate translates p into a MongoDB query document. Like with a Handler,
+// p is checked against the schema set by WithValidator, and an
+// *InternalFieldError is returned if it filters on the fields storing the item
+// metadata unless WithInternalFields is set.
+func (tr Translator) Predicate(p query.Predicate) (bson.M, error) {
+	return tr.t.getQuery(&query.Query{Predicate: p})
+}
+
+// Sort returns the MongoDB sort fields of q, as accepted by mgo.Query.Sort,
+// falling back to the default sort when q has none. An *InternalFieldError is
+// returned if q sorts on the fields storing the item metadata unless
+// WithInternalFields is set.
+func (tr Translator) Sort(q *query.Query) ([]string, error) {
+	if _, err := tr.t.getQuery(&query.Query{Sort: q.Sort}); err != nil {
+		return nil, err
+	}
+	return tr.t.getSort(q), nil
+}
+
+// Aggregate translates a into the document of a $group stage. An
+// *InternalFieldError is returned if a groups on the fields storing the item
+// metadata unless WithInternalFields is set.
+func (tr Translator) Aggregate(a query.Aggregate) (bson.M, error) {
+	return tr.t.getAggregateQuery(&query.Query{Aggregate: a})
+}
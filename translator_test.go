@@ -0,0 +1,89 @@
+package mongo
+
+import (
+	"testing"
+
+	"github.com/oktacode/rest-layer/schema"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTranslator(t *testing.T) {
+	tr, err := NewTranslator()
+	require.NoError(t, err)
+
+	got, err := tr.Predicate(query.MustParsePredicate(`{id:"1",f:{$gt:1}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "1", "f": bson.M{"$gt": float64(1)}}, got)
+
+	srt, err := tr.Sort(&query.Query{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"_id"}, srt)
+	srt, err = tr.Sort(&query.Query{Sort: query.Sort{{Name: "updated", Reversed: true}, {Name: "name"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-_updated", "name"}, srt)
+
+	grp, err := tr.Aggregate(query.MustParseAggregate(`{category:{$group:true}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": "$category", "total": bson.M{"$sum": 1}}, grp)
+}
+
+func TestTranslatorOptions(t *testing.T) {
+	hex := "5a934e000102030405000000"
+	tr, err := NewTranslator(WithObjectID(), WithDefaultSort([]string{"-updated"}))
+	require.NoError(t, err)
+	got, err := tr.Predicate(query.MustParsePredicate(`{id:"` + hex + `"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": bson.ObjectIdHex(hex)}, got)
+	srt, err := tr.Sort(&query.Query{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-_updated"}, srt)
+	got, err = tr.Predicate(query.MustParsePredicate(`{id:{$gte:"` + hex + `"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": bson.M{"$gte": bson.ObjectIdHex(hex)}}, got)
+	_, err = tr.Predicate(query.MustParsePredicate(`{id:{$lt:"foo"}}`))
+	assert.EqualError(t, err, `invalid object id: "foo"`)
+
+	_, err = NewTranslator(WithSlice("tags"))
+	assert.Error(t, err)
+
+	h := NewHandler(&mgo.Session{}, "db", "test", WithObjectID())
+	got, err = h.Translator().Predicate(query.MustParsePredicate(`{id:"` + hex + `"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_id": bson.ObjectIdHex(hex)}, got)
+}
+
+func TestTranslatorInternalFields(t *testing.T) {
+	tr, err := NewTranslator()
+	require.NoError(t, err)
+	_, err = tr.Predicate(query.MustParsePredicate(`{_etag:"a"}`))
+	assert.Equal(t, &InternalFieldError{Field: "_etag"}, err)
+	_, err = tr.Sort(&query.Query{Sort: query.Sort{{Name: "_updated"}}})
+	assert.Equal(t, &InternalFieldError{Field: "_updated"}, err)
+	_, err = tr.Aggregate(query.MustParseAggregate(`{_etag:{$group:true}}`))
+	assert.Equal(t, &InternalFieldError{Field: "_etag"}, err)
+
+	tr, err = NewTranslator(WithInternalFields())
+	require.NoError(t, err)
+	got, err := tr.Predicate(query.MustParsePredicate(`{_etag:"a"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"_etag": "a"}, got)
+	srt, err := tr.Sort(&query.Query{Sort: query.Sort{{Name: "_updated"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"_updated"}, srt)
+}
+
+func TestTranslatorValidator(t *testing.T) {
+	tr, err := NewTranslator(WithValidator(schema.Schema{Fields: schema.Fields{
+		"name":   {Filterable: true, Validator: &schema.String{}},
+		"secret": {Validator: &schema.String{}},
+	}}))
+	require.NoError(t, err)
+	_, err = tr.Predicate(query.MustParsePredicate(`{name:{$regex:"^jo"}}`))
+	assert.NoError(t, err)
+	_, err = tr.Predicate(query.MustParsePredicate(`{secret:{$regex:"^s"}}`))
+	assert.Error(t, err)
+}
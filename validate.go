@@ -0,0 +1,106 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ValidationError is returned by Validate when one of its checks fails. Err is
+// ErrUnavailable when the database could not be reached, ErrUnauthorized when
+// the permissions are missing, or the error returned by the database
+// otherwise.
+type ValidationError struct {
+	// Check is the failed check: ping, list or find.
+	Check string
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s check failed: %v", e.Check, e.Err)
+}
+
+// Unwrap returns the cause of the failure, for use with errors.Is.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// probe runs the commands of Validate.
+type probe interface {
+	Ping() error
+	Run(cmd interface{}, result interface{}) error
+}
+
+// dbProbe runs the commands of Validate against a database.
+type dbProbe struct {
+	db *mgo.Database
+}
+
+func (p dbProbe) Ping() error {
+	return p.db.Session.Ping()
+}
+
+func (p dbProbe) Run(cmd interface{}, result interface{}) error {
+	return p.db.Run(cmd, result)
+}
+
+// Validate checks that the database can be reached and that the handler is
+// allowed to list and read its collection, for instance to fail fast at
+// startup. It pings the server, lists the collection and runs a find matching
+// no item. A failed check is reported with a *ValidationError, whose cause
+// tells if the database is unreachable (ErrUnavailable) or if the permissions
+// are missing (ErrUnauthorized). A missing collection is not an error.
+func (m Handler) Validate(ctx context.Context) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+	c, err := m.c(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.close(c)
+	if err := validate(dbProbe{c.Database}, c.Name); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// validate runs the checks of Validate for the collection coll using p.
+func validate(p probe, coll string) error {
+	if err := p.Ping(); err != nil {
+		return validationError("ping", err)
+	}
+	err := p.Run(bson.D{
+		{Name: "listCollections", Value: 1},
+		{Name: "filter", Value: bson.M{"name": coll}},
+		{Name: "nameOnly", Value: true},
+	}, nil)
+	if err != nil {
+		return validationError("list", err)
+	}
+	err = p.Run(bson.D{
+		{Name: "find", Value: coll},
+		{Name: "filter", Value: bson.M{"_id": bson.M{"$exists": false}}},
+		{Name: "limit", Value: 1},
+		{Name: "singleBatch", Value: true},
+	}, nil)
+	if err != nil {
+		return validationError("find", err)
+	}
+	return nil
+}
+
+// validationError classifies the error err of a Validate check.
+func validationError(check string, err error) error {
+	switch {
+	case isUnauthorized(err):
+		err = ErrUnauthorized
+	case isUnavailable(err):
+		err = ErrUnavailable
+	}
+	return &ValidationError{Check: check, Err: err}
+}
@@ -0,0 +1,77 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeProbe fails the ping with pingErr and the commands with the error
+// registered for their name.
+type fakeProbe struct {
+	pingErr error
+	runErrs map[string]error
+}
+
+func (p fakeProbe) Ping() error {
+	return p.pingErr
+}
+
+func (p fakeProbe) Run(cmd interface{}, result interface{}) error {
+	return p.runErrs[cmd.(bson.D)[0].Name]
+}
+
+func TestValidateChecks(t *testing.T) {
+	other := &mgo.QueryError{Code: 2, Message: "bad value"}
+	unauthorized := &mgo.QueryError{Code: 13, Message: "not authorized on db to execute command { find: \"test\" }"}
+	cases := []struct {
+		name  string
+		probe fakeProbe
+		check string
+		cause error
+	}{
+		{"unreachable", fakeProbe{pingErr: errors.New("no reachable servers")}, "ping", ErrUnavailable},
+		{"connection lost", fakeProbe{runErrs: map[string]error{"listCollections": io.EOF}}, "list", ErrUnavailable},
+		{"auth failed", fakeProbe{pingErr: &mgo.QueryError{Code: 18, Message: "Authentication failed."}}, "ping", ErrUnauthorized},
+		{"cannot list", fakeProbe{runErrs: map[string]error{"listCollections": &mgo.QueryError{Message: "not authorized on db to execute command"}}}, "list", ErrUnauthorized},
+		{"cannot read", fakeProbe{runErrs: map[string]error{"find": unauthorized}}, "find", ErrUnauthorized},
+		{"other", fakeProbe{runErrs: map[string]error{"find": other}}, "find", other},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validate(tc.probe, "test")
+			vErr, ok := err.(*ValidationError)
+			if !assert.True(t, ok, "got %v", err) {
+				return
+			}
+			assert.Equal(t, tc.check, vErr.Check)
+			assert.Equal(t, tc.cause, vErr.Err)
+			assert.True(t, errors.Is(err, tc.cause))
+		})
+	}
+	assert.NoError(t, validate(fakeProbe{}, "test"))
+	assert.EqualError(t, &ValidationError{Check: "ping", Err: ErrUnavailable}, "ping check failed: database unavailable")
+}
+
+func TestValidateInvalidHandler(t *testing.T) {
+	h := NewHandler(&mgo.Session{}, "db", "test$")
+	assert.Error(t, h.Validate(context.Background()))
+}
+
+func TestValidate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testvalidate")()
+	h := NewHandler(s, "testvalidate", "test")
+	assert.NoError(t, h.Validate(context.Background()))
+}
@@ -0,0 +1,260 @@
+package mongo
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// watchAwaitTime is the time, in milliseconds, the server waits for new
+// changes before returning an empty batch, allowing the context to be checked.
+const watchAwaitTime = 1000
+
+// ChangeEvent describes a change made to the collection of a handler.
+type ChangeEvent struct {
+	// Operation is the type of the change: insert, update, replace or delete.
+	Operation string
+	// ID is the ID of the changed item.
+	ID interface{}
+	// Item is the changed item as it would be returned by Find, or nil for
+	// delete events.
+	Item *resource.Item
+	// Err is set on the last event sent before the channel is closed when
+	// the change stream failed.
+	Err error
+}
+
+// changeDoc is the bson representation of a change stream event.
+type changeDoc struct {
+	OperationType string     `bson:"operationType"`
+	FullDocument  *mongoItem `bson:"fullDocument"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+// cursorReply is the reply of the aggregate and getMore commands.
+type cursorReply struct {
+	Cursor struct {
+		ID         int64      `bson:"id"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+// Watch streams the changes made to the collection using a MongoDB change
+// stream. When the predicate of q is not empty, only the events of items
+// matching it are sent, which excludes delete events. The returned channel is
+// closed when ctx is done or when the stream fails.
+//
+// Change streams require MongoDB 3.6+ running as a replica set or a sharded
+// cluster. As watching is a long running operation, the WithDefaultTimeout
+// option does not apply.
+func (m Handler) Watch(ctx context.Context, q *query.Query) (<-chan ChangeEvent, error) {
+	pipeline := []bson.M{
+		{"$changeStream": bson.M{"fullDocument": "updateLookup"}},
+	}
+	if len(q.Predicate) > 0 {
+		qry, err := m.getQuery(q)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.M{"$match": prefixFields(qry, "fullDocument.")})
+	}
+
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var r cursorReply
+	err = c.Database.Run(bson.D{
+		{Name: "aggregate", Value: c.Name},
+		{Name: "pipeline", Value: pipeline},
+		{Name: "cursor", Value: bson.M{}},
+	}, &r)
+	if err != nil {
+		m.close(c)
+		return nil, m.mapError(err)
+	}
+
+	events := make(chan ChangeEvent)
+	go m.watch(ctx, c, r, events)
+	return events, nil
+}
+
+// watch sends the change stream events of the cursor in r to events until ctx
+// is done or an error occurs.
+func (m Handler) watch(ctx context.Context, c *mgo.Collection, r cursorReply, events chan<- ChangeEvent) {
+	defer close(events)
+	defer m.close(c)
+	id := r.Cursor.ID
+	batch := r.Cursor.FirstBatch
+	for {
+		for _, raw := range batch {
+			e := m.changeEvent(raw)
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				killCursor(c, id)
+				return
+			}
+			if e.Err != nil {
+				killCursor(c, id)
+				return
+			}
+		}
+		if ctx.Err() != nil || id == 0 {
+			killCursor(c, id)
+			return
+		}
+		var next cursorReply
+		err := c.Database.Run(bson.D{
+			{Name: "getMore", Value: id},
+			{Name: "collection", Value: c.Name},
+			{Name: "maxTimeMS", Value: watchAwaitTime},
+		}, &next)
+		if err != nil {
+			select {
+			case events <- ChangeEvent{Err: m.mapError(err)}:
+			case <-ctx.Done():
+			}
+			killCursor(c, id)
+			return
+		}
+		id = next.Cursor.ID
+		batch = next.Cursor.NextBatch
+	}
+}
+
+// changeEvent decodes a change stream event.
+func (m Handler) changeEvent(raw bson.Raw) ChangeEvent {
+	var d changeDoc
+	if err := raw.Unmarshal(&d); err != nil {
+		return ChangeEvent{Err: err}
+	}
+	id, err := m.decodeID(d.DocumentKey.ID)
+	if err != nil {
+		return ChangeEvent{Err: err}
+	}
+	e := ChangeEvent{Operation: d.OperationType, ID: id}
+	if d.FullDocument != nil {
+		item, err := m.toItem(d.FullDocument)
+		if err != nil {
+			return ChangeEvent{Err: err}
+		}
+		e.Item = item
+	}
+	return e
+}
+
+// killCursor releases a server side cursor.
+func killCursor(c *mgo.Collection, id int64) {
+	if id == 0 {
+		return
+	}
+	c.Database.Run(bson.D{
+		{Name: "killCursors", Value: c.Name},
+		{Name: "cursors", Value: []int64{id}},
+	}, nil)
+}
+
+// prefixFields returns a copy of the Mongo query q with all its fields
+// prefixed with p.
+func prefixFields(q bson.M, p string) bson.M {
+	r := make(bson.M, len(q))
+	for k, v := range q {
+		if !strings.HasPrefix(k, "$") {
+			r[p+k] = v
+			continue
+		}
+		if subs, ok := v.([]bson.M); ok {
+			s := make([]bson.M, len(subs))
+			for i, sub := range subs {
+				s[i] = prefixFields(sub, p)
+			}
+			v = s
+		}
+		r[k] = v
+	}
+	return r
+}
+
+// TailEvent is an item read by Tail.
+type TailEvent struct {
+	// Item is the read item.
+	Item *resource.Item
+	// Err is set on the last event sent before the channel is closed when
+	// the cursor failed.
+	Err error
+}
+
+// Tail streams the items matching q stored in a capped collection, starting
+// with the existing ones, then sending the items as they get inserted, using a
+// tailable cursor. The cursor waits for new items for the await time set by
+// WithTailAwaitTime (one second by default) before checking ctx. The returned
+// channel is closed when ctx is done, when the cursor is closed by the server
+// or when it fails, for instance because the collection is not capped, in
+// which case the last event holds the error.
+//
+// As tailing is a long running operation, the WithDefaultTimeout option does
+// not apply.
+func (m Handler) Tail(ctx context.Context, q *query.Query) (<-chan TailEvent, error) {
+	qry, err := m.getQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	c, err := m.c(ctx)
+	if err != nil {
+		return nil, err
+	}
+	await := m.tailAwaitTime
+	if await <= 0 {
+		await = watchAwaitTime * time.Millisecond
+	}
+	iter := c.Find(qry).Tail(await)
+	events := make(chan TailEvent)
+	go m.tail(ctx, c, iter, events)
+	return events, nil
+}
+
+// tail sends the items read from the tailable cursor iter to events until ctx
+// is done or the cursor is closed or fails.
+func (m Handler) tail(ctx context.Context, c *mgo.Collection, iter *mgo.Iter, events chan<- TailEvent) {
+	defer close(events)
+	defer m.close(c)
+	defer iter.Close()
+	for {
+		var mItem mongoItem
+		for iter.Next(&mItem) {
+			e := TailEvent{}
+			e.Item, e.Err = m.toItem(&mItem)
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+			if e.Err != nil {
+				return
+			}
+			mItem = mongoItem{}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := iter.Err(); err != nil {
+			select {
+			case events <- TailEvent{Err: m.mapError(err)}:
+			case <-ctx.Done():
+			}
+			return
+		}
+		if !iter.Timeout() {
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oktacode/rest-layer/resource"
+	"github.com/oktacode/rest-layer/schema/query"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPrefixFields(t *testing.T) {
+	q := bson.M{
+		"name": "foo",
+		"$or":  []bson.M{{"_id": "1"}, {"age": bson.M{"$gt": 1}}},
+	}
+	assert.Equal(t, bson.M{
+		"fullDocument.name": "foo",
+		"$or":               []bson.M{{"fullDocument._id": "1"}, {"fullDocument.age": bson.M{"$gt": 1}}},
+	}, prefixFields(q, "fullDocument."))
+}
+
+func TestWatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testwatch")()
+	// Change streams can only be opened on existing collections
+	require.NoError(t, s.DB("testwatch").C("test").Create(&mgo.CollectionInfo{}))
+	h := NewHandler(s, "testwatch", "test")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	q, err := query.New("", `{name:"foo"}`, "", nil)
+	require.NoError(t, err)
+	events, err := h.Watch(ctx, q)
+	if err != nil {
+		t.Skipf("change streams not supported: %v", err)
+	}
+
+	items := []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "name": "bar"}},
+		{ID: "2", ETag: "b", Payload: map[string]interface{}{"id": "2", "name": "foo"}},
+	}
+	require.NoError(t, h.Insert(context.Background(), items))
+
+	e, ok := <-events
+	if assert.True(t, ok) {
+		assert.NoError(t, e.Err)
+		assert.Equal(t, "insert", e.Operation)
+		assert.Equal(t, "2", e.ID)
+		if assert.NotNil(t, e.Item) {
+			assert.Equal(t, map[string]interface{}{"id": "2", "name": "foo"}, e.Item.Payload)
+			assert.Equal(t, "b", e.Item.ETag)
+		}
+	}
+
+	// The channel is closed once the context is done
+	cancel()
+	for range events {
+	}
+}
+
+func TestTail(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testtail")()
+	require.NoError(t, s.DB("testtail").C("test").Create(&mgo.CollectionInfo{Capped: true, MaxBytes: 1 << 20}))
+	h := NewHandler(s, "testtail", "test", WithTailAwaitTime(100*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1", "kind": "log"}},
+	}))
+
+	q, err := query.New("", `{kind:"log"}`, "", nil)
+	require.NoError(t, err)
+	events, err := h.Tail(ctx, q)
+	require.NoError(t, err)
+	// Let the cursor wait for new items
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "2", ETag: "a", Payload: map[string]interface{}{"id": "2", "kind": "metric"}},
+		{ID: "3", ETag: "a", Payload: map[string]interface{}{"id": "3", "kind": "log"}},
+	}))
+
+	for _, id := range []string{"1", "3"} {
+		select {
+		case e := <-events:
+			assert.NoError(t, e.Err)
+			if assert.NotNil(t, e.Item) {
+				assert.Equal(t, id, e.Item.ID)
+			}
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for item")
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestTailErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+	s, err := mgo.Dial("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cleanup(s, "testtailerrors")()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Tailing a collection which is not capped fails
+	h := NewHandler(s, "testtailerrors", "test")
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1"}},
+	}))
+	events, err := h.Tail(ctx, &query.Query{})
+	require.NoError(t, err)
+	var last TailEvent
+	for e := range events {
+		last = e
+	}
+	assert.Nil(t, last.Item)
+	assert.Error(t, last.Err)
+
+	// Items which can't be decoded end the stream
+	require.NoError(t, s.DB("testtailerrors").C("capped").Create(&mgo.CollectionInfo{Capped: true, MaxBytes: 1 << 20}))
+	h = NewHandler(s, "testtailerrors", "capped")
+	require.NoError(t, h.Insert(ctx, []*resource.Item{
+		{ID: "1", ETag: "a", Payload: map[string]interface{}{"id": "1"}},
+	}))
+	h = NewHandler(s, "testtailerrors", "capped", WithIDCodec(nil, func(interface{}) (string, error) {
+		return "", errors.New("bad id")
+	}))
+	events, err = h.Tail(ctx, &query.Query{})
+	require.NoError(t, err)
+	last = TailEvent{}
+	for e := range events {
+		last = e
+	}
+	assert.EqualError(t, last.Err, "bad id")
+}